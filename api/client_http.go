@@ -4,6 +4,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"net/url"
@@ -33,8 +34,8 @@ type ipswHTTPWrapper struct {
 	httpClient HTTPClient
 }
 
-func (h *ipswHTTPWrapper) makeRequest(url string, headers map[string]string) (body io.Reader, statusCode int, err error) {
-	request, err := http.NewRequest("GET", h.base+url, nil)
+func (h *ipswHTTPWrapper) makeRequest(ctx context.Context, url string, headers map[string]string) (body io.Reader, statusCode int, err error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", h.base+url, nil)
 
 	if err != nil {
 		return nil, 0, err
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"errors"
 	"io"
 	"strings"
@@ -20,7 +21,11 @@ type ipswHTTPWrapper struct {
 	base string
 }
 
-func (h *ipswHTTPWrapper) makeRequest(url string, headers map[string]string) (body io.Reader, statusCode int, err error) {
+func (h *ipswHTTPWrapper) makeRequest(ctx context.Context, url string, headers map[string]string) (body io.Reader, statusCode int, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
 	r := xhr.NewRequest("GET", h.base+url)
 	r.Timeout = 30000 // 30 seconds
 	r.ResponseType = xhr.Text
@@ -29,9 +34,22 @@ func (h *ipswHTTPWrapper) makeRequest(url string, headers map[string]string) (bo
 		r.SetRequestHeader(key, val)
 	}
 
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Abort()
+		case <-done:
+		}
+	}()
+
 	err = r.Send(nil)
 
-	if err != nil {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, 0, ctxErr
+	} else if err != nil {
 		return nil, 0, err
 	}
 
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -162,6 +163,10 @@ func parseJSON(r io.Reader, output interface{}) error {
 }
 
 func (c *IPSWClient) Devices(onlyShowDevicesWithKeys bool) ([]BaseDevice, error) {
+	return c.DevicesContext(context.Background(), onlyShowDevicesWithKeys)
+}
+
+func (c *IPSWClient) DevicesContext(ctx context.Context, onlyShowDevicesWithKeys bool) ([]BaseDevice, error) {
 	var devices []BaseDevice
 
 	requestURL := "/devices"
@@ -170,7 +175,7 @@ func (c *IPSWClient) Devices(onlyShowDevicesWithKeys bool) ([]BaseDevice, error)
 		requestURL += "?keysOnly=true"
 	}
 
-	resp, _, err := c.client.makeRequest(requestURL, nil)
+	resp, _, err := c.client.makeRequest(ctx, requestURL, nil)
 
 	if err != nil {
 		return nil, err
@@ -182,9 +187,13 @@ func (c *IPSWClient) Devices(onlyShowDevicesWithKeys bool) ([]BaseDevice, error)
 }
 
 func (c *IPSWClient) DeviceInformation(identifier string) (*Device, error) {
+	return c.DeviceInformationContext(context.Background(), identifier)
+}
+
+func (c *IPSWClient) DeviceInformationContext(ctx context.Context, identifier string) (*Device, error) {
 	var device *Device
 
-	resp, _, err := c.client.makeRequest("/device/"+identifier, nil)
+	resp, _, err := c.client.makeRequest(ctx, "/device/"+identifier, nil)
 
 	if err != nil {
 		return nil, err
@@ -196,9 +205,13 @@ func (c *IPSWClient) DeviceInformation(identifier string) (*Device, error) {
 }
 
 func (c *IPSWClient) OTADeviceInformation(identifier string) (*OTADevice, error) {
+	return c.OTADeviceInformationContext(context.Background(), identifier)
+}
+
+func (c *IPSWClient) OTADeviceInformationContext(ctx context.Context, identifier string) (*OTADevice, error) {
 	var device *OTADevice
 
-	resp, _, err := c.client.makeRequest("/device/"+identifier+"?type=ota", nil)
+	resp, _, err := c.client.makeRequest(ctx, "/device/"+identifier+"?type=ota", nil)
 
 	if err != nil {
 		return nil, err
@@ -210,9 +223,13 @@ func (c *IPSWClient) OTADeviceInformation(identifier string) (*OTADevice, error)
 }
 
 func (c *IPSWClient) IPSWInformation(identifier, buildid string) (*Firmware, error) {
+	return c.IPSWInformationContext(context.Background(), identifier, buildid)
+}
+
+func (c *IPSWClient) IPSWInformationContext(ctx context.Context, identifier, buildid string) (*Firmware, error) {
 	var fw *Firmware
 
-	resp, _, err := c.client.makeRequest(fmt.Sprintf("/ipsw/%s/%s", identifier, buildid), nil)
+	resp, _, err := c.client.makeRequest(ctx, fmt.Sprintf("/ipsw/%s/%s", identifier, buildid), nil)
 
 	if err != nil {
 		return nil, err
@@ -224,9 +241,13 @@ func (c *IPSWClient) IPSWInformation(identifier, buildid string) (*Firmware, err
 }
 
 func (c *IPSWClient) OTAInformation(identifier, buildid, prerequisite string) (*OTAFirmware, error) {
+	return c.OTAInformationContext(context.Background(), identifier, buildid, prerequisite)
+}
+
+func (c *IPSWClient) OTAInformationContext(ctx context.Context, identifier, buildid, prerequisite string) (*OTAFirmware, error) {
 	var fw *OTAFirmware
 
-	resp, _, err := c.client.makeRequest(fmt.Sprintf("/ota/%s/%s", identifier, buildid), nil)
+	resp, _, err := c.client.makeRequest(ctx, fmt.Sprintf("/ota/%s/%s", identifier, buildid), nil)
 
 	if err != nil {
 		return nil, err
@@ -238,9 +259,13 @@ func (c *IPSWClient) OTAInformation(identifier, buildid, prerequisite string) (*
 }
 
 func (c *IPSWClient) IPSWsForVersion(version string) ([]Firmware, error) {
+	return c.IPSWsForVersionContext(context.Background(), version)
+}
+
+func (c *IPSWClient) IPSWsForVersionContext(ctx context.Context, version string) ([]Firmware, error) {
 	var fws []Firmware
 
-	resp, _, err := c.client.makeRequest("/ipsw/"+version, nil)
+	resp, _, err := c.client.makeRequest(ctx, "/ipsw/"+version, nil)
 
 	if err != nil {
 		return nil, err
@@ -252,9 +277,13 @@ func (c *IPSWClient) IPSWsForVersion(version string) ([]Firmware, error) {
 }
 
 func (c *IPSWClient) OTAsForVersion(version string) ([]OTAFirmware, error) {
+	return c.OTAsForVersionContext(context.Background(), version)
+}
+
+func (c *IPSWClient) OTAsForVersionContext(ctx context.Context, version string) ([]OTAFirmware, error) {
 	var fws []OTAFirmware
 
-	resp, _, err := c.client.makeRequest("/ota/"+version, nil)
+	resp, _, err := c.client.makeRequest(ctx, "/ota/"+version, nil)
 
 	if err != nil {
 		return nil, err
@@ -266,9 +295,13 @@ func (c *IPSWClient) OTAsForVersion(version string) ([]OTAFirmware, error) {
 }
 
 func (c *IPSWClient) ITunes(platform string) ([]ITunes, error) {
+	return c.ITunesContext(context.Background(), platform)
+}
+
+func (c *IPSWClient) ITunesContext(ctx context.Context, platform string) ([]ITunes, error) {
 	var itunes []ITunes
 
-	resp, _, err := c.client.makeRequest("/itunes/"+platform, nil)
+	resp, _, err := c.client.makeRequest(ctx, "/itunes/"+platform, nil)
 
 	if err != nil {
 		return nil, err
@@ -280,9 +313,13 @@ func (c *IPSWClient) ITunes(platform string) ([]ITunes, error) {
 }
 
 func (c *IPSWClient) KeysList(identifier string) ([]FirmwareInfo, error) {
+	return c.KeysListContext(context.Background(), identifier)
+}
+
+func (c *IPSWClient) KeysListContext(ctx context.Context, identifier string) ([]FirmwareInfo, error) {
 	var info []FirmwareInfo
 
-	resp, _, err := c.client.makeRequest("/keys/device/"+identifier, nil)
+	resp, _, err := c.client.makeRequest(ctx, "/keys/device/"+identifier, nil)
 
 	if err != nil {
 		return nil, err
@@ -294,9 +331,13 @@ func (c *IPSWClient) KeysList(identifier string) ([]FirmwareInfo, error) {
 }
 
 func (c *IPSWClient) KeysForIPSW(identifier, buildid string) (*FirmwareInfo, error) {
+	return c.KeysForIPSWContext(context.Background(), identifier, buildid)
+}
+
+func (c *IPSWClient) KeysForIPSWContext(ctx context.Context, identifier, buildid string) (*FirmwareInfo, error) {
 	var info *FirmwareInfo
 
-	resp, _, err := c.client.makeRequest(fmt.Sprintf("/keys/ipsw/%s/%s", identifier, buildid), nil)
+	resp, _, err := c.client.makeRequest(ctx, fmt.Sprintf("/keys/ipsw/%s/%s", identifier, buildid), nil)
 
 	if err != nil {
 		return nil, err
@@ -308,9 +349,13 @@ func (c *IPSWClient) KeysForIPSW(identifier, buildid string) (*FirmwareInfo, err
 }
 
 func (c *IPSWClient) ReleaseInformation() ([]ReleasesByDate, error) {
+	return c.ReleaseInformationContext(context.Background())
+}
+
+func (c *IPSWClient) ReleaseInformationContext(ctx context.Context) ([]ReleasesByDate, error) {
 	var releases []ReleasesByDate
 
-	resp, _, err := c.client.makeRequest("/releases", nil)
+	resp, _, err := c.client.makeRequest(ctx, "/releases", nil)
 
 	if err != nil {
 		return nil, err
@@ -326,9 +371,13 @@ type modelResponse struct {
 }
 
 func (c *IPSWClient) IdentifyModel(model string) (string, error) {
+	return c.IdentifyModelContext(context.Background(), model)
+}
+
+func (c *IPSWClient) IdentifyModelContext(ctx context.Context, model string) (string, error) {
 	var r modelResponse
 
-	resp, _, err := c.client.makeRequest("/model/"+model, nil)
+	resp, _, err := c.client.makeRequest(ctx, "/model/"+model, nil)
 
 	if err != nil {
 		return "", err
@@ -340,7 +389,11 @@ func (c *IPSWClient) IdentifyModel(model string) (string, error) {
 }
 
 func (c *IPSWClient) URL(identifier, buildid string) (string, error) {
-	fw, err := c.IPSWInformation(identifier, buildid)
+	return c.URLContext(context.Background(), identifier, buildid)
+}
+
+func (c *IPSWClient) URLContext(ctx context.Context, identifier, buildid string) (string, error) {
+	fw, err := c.IPSWInformationContext(ctx, identifier, buildid)
 
 	if err != nil {
 		return "", err
@@ -350,7 +403,11 @@ func (c *IPSWClient) URL(identifier, buildid string) (string, error) {
 }
 
 func (c *IPSWClient) OTADocumentation(device, version string) ([]byte, error) {
-	resp, statusCode, err := c.client.makeRequest("/ota/documentation/"+device+"/"+version, nil)
+	return c.OTADocumentationContext(context.Background(), device, version)
+}
+
+func (c *IPSWClient) OTADocumentationContext(ctx context.Context, device, version string) ([]byte, error) {
+	resp, statusCode, err := c.client.makeRequest(ctx, "/ota/documentation/"+device+"/"+version, nil)
 
 	if err != nil {
 		return nil, err
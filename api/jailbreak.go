@@ -1,6 +1,10 @@
 package api
 
-import "github.com/cj123/canijailbreak.com/model"
+import (
+	"context"
+
+	"github.com/cj123/canijailbreak.com/model"
+)
 
 const CanIJailbreakURL = "https://canijailbreak.com/"
 
@@ -16,9 +20,13 @@ type CanIJailbreakClient struct {
 }
 
 func (c *CanIJailbreakClient) GetJailbreaks() (*model.Jailbreaks, error) {
+	return c.GetJailbreaksContext(context.Background())
+}
+
+func (c *CanIJailbreakClient) GetJailbreaksContext(ctx context.Context) (*model.Jailbreaks, error) {
 	var jbs *model.Jailbreaks
 
-	resp, _, err := c.client.makeRequest("jailbreaks.json", nil)
+	resp, _, err := c.client.makeRequest(ctx, "jailbreaks.json", nil)
 
 	if err != nil {
 		return nil, err
@@ -0,0 +1,490 @@
+package ipsw
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// contextReaderAt binds a context to each read of a Source.
+type contextReaderAt struct {
+	ctx context.Context
+	src Source
+}
+
+func (c contextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return c.src.ReadAt(c.ctx, p, off)
+}
+
+// scopedReaderAt is the ReaderAt given to archive/zip. archive/zip keeps hold of it,
+// so the context for its reads is set for the duration of each call into archive/zip.
+type scopedReaderAt struct {
+	mu  sync.Mutex
+	ctx context.Context
+	src Source
+}
+
+func (s *scopedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return s.src.ReadAt(s.ctx, p, off)
+}
+
+func (s *scopedReaderAt) do(ctx context.Context, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ctx = ctx
+	defer func() { s.ctx = context.Background() }()
+
+	return fn()
+}
+
+// sourceName describes src in errors.
+func sourceName(src Source) string {
+	if s, ok := src.(fmt.Stringer); ok {
+		return s.String()
+	}
+
+	return fmt.Sprintf("%T", src)
+}
+
+// zipArchive is the central directory of a zip. It is safe for concurrent use
+// and can be used to extract any number of files.
+type zipArchive struct {
+	*zip.Reader
+
+	src   Source
+	scope *scopedReaderAt
+	opts  *DownloadOptions
+}
+
+// openZip reads the central directory of the zip in src, retrying as opts allows.
+// If src can cache its central directory, the cached copy is used and the reads
+// needed to parse a new directory are stored.
+func openZip(ctx context.Context, src Source, opts *DownloadOptions) (*zipArchive, error) {
+	cacher, canCache := src.(directoryCacher)
+
+	var (
+		directory *directorySource
+		reader    = src
+	)
+
+	if canCache {
+		reads, ok := cacher.cachedDirectory(ctx)
+		directory = &directorySource{Source: src, reads: reads, recording: !ok}
+		reader = directory
+	}
+
+	z := &zipArchive{
+		src:   src,
+		scope: &scopedReaderAt{ctx: context.Background(), src: reader},
+		opts:  opts,
+	}
+
+	attempts := 0
+
+	err := opts.retry().Do(ctx, opts.logger(), func(attempt int) error {
+		attempts = attempt
+
+		if attempt > 1 {
+			if r, ok := src.(resettableSource); ok {
+				r.reset()
+			}
+
+			if directory != nil {
+				// the cached directory may be what is broken
+				directory.mu.Lock()
+				directory.reads, directory.recording = nil, true
+				directory.mu.Unlock()
+			}
+		}
+
+		size, err := src.Size(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		return z.scope.do(ctx, func() error {
+			var err error
+
+			z.Reader, err = zip.NewReader(z.scope, size)
+
+			return err
+		})
+	})
+
+	if err == zip.ErrFormat {
+		return nil, &ZipFormatError{Resource: sourceName(src), Attempts: attempts, Err: err}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if directory != nil {
+		directory.mu.Lock()
+
+		if directory.recording {
+			cacher.storeDirectory(ctx, directory.reads)
+			directory.recording = false
+		}
+
+		directory.mu.Unlock()
+	}
+
+	return z, nil
+}
+
+func (z *zipArchive) file(name string) (*zip.File, error) {
+	for _, f := range z.File {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+
+	return nil, &FileNotFoundError{Name: name, Resource: sourceName(z.src)}
+}
+
+// dataOffset returns the offset of the compressed data of f, reading its local header with ctx.
+func (z *zipArchive) dataOffset(ctx context.Context, f *zip.File) (int64, error) {
+	var offset int64
+
+	err := z.scope.do(ctx, func() error {
+		var err error
+
+		offset, err = f.DataOffset()
+
+		return err
+	})
+
+	return offset, err
+}
+
+const (
+	zipLocalHeaderLen     = 30
+	zipDirectoryHeaderLen = 46
+	zipDirectoryEndLen    = 22
+	zipDirectory64LocLen  = 20
+	zipDirectory64EndLen  = 56
+
+	zipLocalHeaderSignature     = 0x04034b50
+	zipDirectoryHeaderSignature = 0x02014b50
+	zipDirectoryEndSignature    = 0x06054b50
+	zipDirectory64LocSignature  = 0x07064b50
+	zipDirectory64EndSignature  = 0x06064b50
+
+	zip64ExtraID = 0x0001
+)
+
+// headerOffsets returns the offset of the local header of each file in z.File, in order, so that the
+// headers can be read along with the data which follows them. archive/zip keeps these offsets to itself,
+// so they are read from the central directory again.
+func (z *zipArchive) headerOffsets(ctx context.Context) ([]int64, error) {
+	r := contextReaderAt{ctx: ctx, src: z.scope.src}
+
+	size, err := z.src.Size(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	end, endOffset, err := findDirectoryEnd(r, size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	directorySize, directoryOffset := uint64(binary.LittleEndian.Uint32(end[12:])), uint64(binary.LittleEndian.Uint32(end[16:]))
+
+	if binary.LittleEndian.Uint16(end[10:]) == 0xffff || directorySize == 0xffffffff || directoryOffset == 0xffffffff {
+		if endOffset < zipDirectory64LocLen {
+			return nil, zip.ErrFormat
+		}
+
+		locator := make([]byte, zipDirectory64LocLen)
+
+		if _, err := r.ReadAt(locator, endOffset-zipDirectory64LocLen); err != nil {
+			return nil, err
+		}
+
+		if binary.LittleEndian.Uint32(locator) != zipDirectory64LocSignature {
+			return nil, zip.ErrFormat
+		}
+
+		endOffset = int64(binary.LittleEndian.Uint64(locator[8:]))
+		end64 := make([]byte, zipDirectory64EndLen)
+
+		if endOffset < 0 || endOffset > size-zipDirectory64EndLen {
+			return nil, zip.ErrFormat
+		}
+
+		if _, err := r.ReadAt(end64, endOffset); err != nil {
+			return nil, err
+		}
+
+		if binary.LittleEndian.Uint32(end64) != zipDirectory64EndSignature {
+			return nil, zip.ErrFormat
+		}
+
+		directorySize, directoryOffset = binary.LittleEndian.Uint64(end64[40:]), binary.LittleEndian.Uint64(end64[48:])
+	}
+
+	if directorySize > uint64(size) || directoryOffset > uint64(size) {
+		return nil, zip.ErrFormat
+	}
+
+	// archive/zip allows for data before the archive, unless the directory is where the end record says it is.
+	// Whichever directory it read, the names in it match those of z.File.
+	for _, base := range []int64{0, endOffset - int64(directorySize) - int64(directoryOffset)} {
+		start := base + int64(directoryOffset)
+
+		if base < 0 || start+int64(directorySize) > size {
+			continue
+		}
+
+		directory := make([]byte, directorySize)
+
+		if _, err := r.ReadAt(directory, start); err != nil {
+			return nil, err
+		}
+
+		if offsets, ok := directoryHeaderOffsets(directory, z.File, base); ok {
+			return offsets, nil
+		}
+	}
+
+	return nil, zip.ErrFormat
+}
+
+// findDirectoryEnd returns the end of central directory record of the zip, and its offset.
+// The same reads are made as by archive/zip, so they are served by a cached directory.
+func findDirectoryEnd(r io.ReaderAt, size int64) ([]byte, int64, error) {
+	for _, length := range []int64{1024, 65 * 1024} {
+		if length > size {
+			length = size
+		}
+
+		buf := make([]byte, length)
+
+		if _, err := r.ReadAt(buf, size-length); err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+
+		for i := len(buf) - zipDirectoryEndLen; i >= 0; i-- {
+			if binary.LittleEndian.Uint32(buf[i:]) == zipDirectoryEndSignature &&
+				i+zipDirectoryEndLen+int(binary.LittleEndian.Uint16(buf[i+20:])) <= len(buf) {
+				return buf[i : i+zipDirectoryEndLen], size - length + int64(i), nil
+			}
+		}
+
+		if length == size {
+			break
+		}
+	}
+
+	return nil, 0, zip.ErrFormat
+}
+
+// directoryHeaderOffsets reads the local header offset of each file from the central directory.
+// It reports false if the directory does not hold files, in order.
+func directoryHeaderOffsets(directory []byte, files []*zip.File, base int64) ([]int64, bool) {
+	offsets := make([]int64, 0, len(files))
+
+	for _, f := range files {
+		if len(directory) < zipDirectoryHeaderLen || binary.LittleEndian.Uint32(directory) != zipDirectoryHeaderSignature {
+			return nil, false
+		}
+
+		nameLen := int(binary.LittleEndian.Uint16(directory[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(directory[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(directory[32:]))
+		headerLen := zipDirectoryHeaderLen + nameLen + extraLen + commentLen
+
+		if len(directory) < headerLen || string(directory[zipDirectoryHeaderLen:zipDirectoryHeaderLen+nameLen]) != f.Name {
+			return nil, false
+		}
+
+		offset := uint64(binary.LittleEndian.Uint32(directory[42:]))
+
+		if offset == 0xffffffff {
+			var ok bool
+
+			extra := directory[zipDirectoryHeaderLen+nameLen : zipDirectoryHeaderLen+nameLen+extraLen]
+			offset, ok = zip64HeaderOffset(extra, directory)
+
+			if !ok {
+				return nil, false
+			}
+		}
+
+		offsets = append(offsets, base+int64(offset))
+		directory = directory[headerLen:]
+	}
+
+	return offsets, true
+}
+
+// zip64HeaderOffset reads the local header offset from the zip64 extra field of a directory header.
+// The field holds only the values which overflowed in the header, in a fixed order.
+func zip64HeaderOffset(extra, header []byte) (uint64, bool) {
+	for len(extra) >= 4 {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if len(extra) < 4+size {
+			return 0, false
+		}
+
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		if id != zip64ExtraID {
+			continue
+		}
+
+		// the uncompressed and compressed sizes come first, if they overflowed
+		for _, at := range []int{24, 20} {
+			if binary.LittleEndian.Uint32(header[at:]) == 0xffffffff {
+				if len(field) < 8 {
+					return 0, false
+				}
+
+				field = field[8:]
+			}
+		}
+
+		if len(field) < 8 {
+			return 0, false
+		}
+
+		return binary.LittleEndian.Uint64(field), true
+	}
+
+	return 0, false
+}
+
+// readLocalHeader reads the fixed size part of the local header of f from r, returning the length of
+// the name and extra field which follow it.
+func readLocalHeader(r io.Reader, f *zip.File) (int64, error) {
+	header := make([]byte, zipLocalHeaderLen)
+
+	if _, err := io.ReadFull(r, header); err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return 0, err
+	}
+
+	nameLen := int(binary.LittleEndian.Uint16(header[26:]))
+
+	if binary.LittleEndian.Uint32(header) != zipLocalHeaderSignature || nameLen != len(f.Name) {
+		return 0, zip.ErrFormat
+	}
+
+	return int64(nameLen) + int64(binary.LittleEndian.Uint16(header[28:])), nil
+}
+
+// open opens f for reading, making all requests with ctx.
+func (z *zipArchive) open(ctx context.Context, f *zip.File) (io.ReadCloser, error) {
+	offset, err := z.dataOffset(ctx, f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decompressor(f, io.NewSectionReader(contextReaderAt{ctx: ctx, src: z.src}, offset, int64(f.CompressedSize64)))
+}
+
+// extract writes the contents of name to w. Failures are retried as long as nothing has been written.
+func (z *zipArchive) extract(ctx context.Context, name string, w io.Writer) error {
+	f, err := z.file(name)
+
+	if err != nil {
+		return err
+	}
+
+	counter := &countingWriter{w: w}
+
+	return z.opts.retry().Do(ctx, z.opts.logger(), func(attempt int) error {
+		rc, err := z.open(ctx, f)
+
+		if err != nil {
+			return err
+		}
+
+		defer rc.Close()
+
+		_, err = io.Copy(counter, rc)
+
+		if err != nil && counter.n > 0 {
+			// w can't be rewound
+			return permanentError{err}
+		}
+
+		return err
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// decompressor reads the contents of f from its compressed data r.
+func decompressor(f *zip.File, r io.Reader) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+
+	switch f.Method {
+	case zip.Store:
+		rc = ioutil.NopCloser(r)
+	case zip.Deflate:
+		rc = flate.NewReader(r)
+	default:
+		return nil, zip.ErrAlgorithm
+	}
+
+	return &checksumReader{rc: rc, hash: crc32.NewIEEE(), file: f}, nil
+}
+
+// checksumReader verifies the size and CRC-32 of a file once it has been read in full.
+type checksumReader struct {
+	rc   io.ReadCloser
+	hash hash.Hash32
+	file *zip.File
+	n    uint64
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	c.hash.Write(p[:n])
+	c.n += uint64(n)
+
+	if err == io.EOF {
+		if c.n != c.file.UncompressedSize64 {
+			return n, io.ErrUnexpectedEOF
+		}
+
+		if c.file.CRC32 != 0 && c.hash.Sum32() != c.file.CRC32 {
+			return n, zip.ErrChecksum
+		}
+	} else if err == nil && c.n > c.file.UncompressedSize64 {
+		return n, errors.New("zip: file is larger than its uncompressed size")
+	}
+
+	return n, err
+}
+
+func (c *checksumReader) Close() error {
+	return c.rc.Close()
+}
@@ -0,0 +1,573 @@
+package ipsw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"howett.net/plist"
+)
+
+// SHSHBlob is a saved signing ticket, from a .shsh or .shsh2 file.
+type SHSHBlob struct {
+	// APTicket is the ApImg4Ticket of an IMG4 blob, or the APTicket of an IMG3 one.
+	APTicket []byte
+
+	// Generator is the nonce generator saved with an .shsh2 blob, e.g. 0x1111111111111111.
+	Generator string
+
+	// BBTicket is the baseband ticket, if the baseband was personalised.
+	BBTicket []byte
+
+	// UpdateInstall is the ticket for the Update build identity, saved alongside an Erase one.
+	UpdateInstall *SHSHBlob
+
+	// Components are the per-component blobs of an IMG3 blob, by their BuildManifest name.
+	Components map[string]*SHSHComponent
+
+	// Raw is every key of the blob's plist.
+	Raw map[string]interface{}
+}
+
+// SHSHComponent is the signature of a single component in an IMG3 blob.
+type SHSHComponent struct {
+	Blob          []byte
+	Digest        []byte
+	PartialDigest []byte
+}
+
+// ParseSHSHBlob parses a .shsh or .shsh2 plist.
+func ParseSHSHBlob(data []byte) (*SHSHBlob, error) {
+	var raw map[string]interface{}
+
+	if _, err := plist.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	return newSHSHBlob(raw)
+}
+
+func newSHSHBlob(raw map[string]interface{}) (*SHSHBlob, error) {
+	blob := &SHSHBlob{Raw: raw, Components: make(map[string]*SHSHComponent)}
+
+	if ticket, ok := raw["ApImg4Ticket"].([]byte); ok {
+		blob.APTicket = ticket
+	} else if ticket, ok := raw["APTicket"].([]byte); ok {
+		blob.APTicket = ticket
+	}
+
+	blob.Generator, _ = raw["generator"].(string)
+	blob.BBTicket, _ = raw["BBTicket"].([]byte)
+
+	if update, ok := raw[shsh2UpdateInstallKey].(map[string]interface{}); ok {
+		var err error
+
+		blob.UpdateInstall, err = newSHSHBlob(update)
+
+		if err != nil {
+			return nil, fmt.Errorf("ipsw: %s: %w", shsh2UpdateInstallKey, err)
+		}
+	}
+
+	for name, value := range raw {
+		dict, ok := value.(map[string]interface{})
+
+		if !ok {
+			continue
+		}
+
+		component := new(SHSHComponent)
+		component.Blob, _ = dict["Blob"].([]byte)
+		component.Digest, _ = dict["Digest"].([]byte)
+		component.PartialDigest, _ = dict["PartialDigest"].([]byte)
+
+		if component.Blob != nil {
+			blob.Components[name] = component
+		}
+	}
+
+	if blob.APTicket == nil && len(blob.Components) == 0 {
+		return nil, errors.New("ipsw: blob has no ticket or components")
+	}
+
+	return blob, nil
+}
+
+// ReadSHSHBlob reads all of r and parses it as a .shsh or .shsh2 plist.
+func ReadSHSHBlob(r io.Reader) (*SHSHBlob, error) {
+	data, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSHSHBlob(data)
+}
+
+// IsIMG4 reports whether the blob is for an IMG4 device.
+func (b *SHSHBlob) IsIMG4() bool {
+	if b.Raw == nil {
+		return b.APTicket != nil && len(b.Components) == 0
+	}
+
+	_, ok := b.Raw["ApImg4Ticket"]
+
+	return ok
+}
+
+// IM4M parses the ApImg4Ticket of the blob.
+func (b *SHSHBlob) IM4M() (*IM4M, error) {
+	if !b.IsIMG4() {
+		return nil, &ImageFormatError{Format: IM4MMagic, Err: errors.New("blob has no ApImg4Ticket")}
+	}
+
+	return ParseIM4M(b.APTicket)
+}
+
+// ECID returns the ECID the blob was saved for.
+func (b *SHSHBlob) ECID() (uint64, error) {
+	if b.IsIMG4() {
+		m, err := b.IM4M()
+
+		if err != nil {
+			return 0, err
+		}
+
+		return m.ECID, nil
+	}
+
+	for _, component := range b.Components {
+		sig, err := ParseIMG3Signature(component.Blob)
+
+		if err != nil {
+			return 0, err
+		}
+
+		return sig.ECID, nil
+	}
+
+	return 0, &ElementNotFoundError{Signature: EcidElement}
+}
+
+// BlobVerification is the result of checking an SHSH blob against a BuildManifest.
+type BlobVerification struct {
+	// Valid is true if the blob was signed for Identity: the chip and board match, and every
+	// component it signs is in Identity, which has no trusted component the blob does not sign.
+	Valid bool
+
+	// Identity is the build identity which best matches the blob, even if the blob is not valid for it.
+	Identity *BuildIdentity
+
+	// RestoreBehavior is the restore behavior of Identity, "Erase" or "Update".
+	RestoreBehavior string
+
+	ECID uint64
+
+	// ChipMatches and BoardMatches are whether the CHIP and BORD of the ticket match Identity.
+	// For IMG3 blobs they are read from the APTicket, and are false if it has none.
+	ChipMatches  bool
+	BoardMatches bool
+
+	// Matched are the components whose digests match Identity.
+	Matched []string
+
+	// Mismatched are the components signed by the blob whose digests are not in Identity.
+	Mismatched []string
+
+	// Missing are the trusted components of Identity which are not signed by the blob.
+	Missing []string
+}
+
+func (v *BlobVerification) score() int {
+	score := len(v.Matched) - len(v.Mismatched)*1000
+
+	if !v.ChipMatches || !v.BoardMatches {
+		score -= 1000000
+	}
+
+	return score
+}
+
+// Verify checks the blob against each identity of manifest, returning the result for the identity that fits best.
+func (b *SHSHBlob) Verify(manifest *BuildManifest) (*BlobVerification, error) {
+	if len(manifest.BuildIdentities) == 0 {
+		return nil, errors.New("ipsw: manifest has no build identities")
+	}
+
+	var (
+		verify func(identity *BuildIdentity) *BlobVerification
+		ecid   uint64
+	)
+
+	if b.IsIMG4() {
+		m, err := b.IM4M()
+
+		if err != nil {
+			return nil, err
+		}
+
+		ecid = m.ECID
+		verify = func(identity *BuildIdentity) *BlobVerification {
+			return verifyIM4M(m, identity)
+		}
+	} else {
+		var err error
+
+		ecid, err = b.ECID()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var ticket *IMG3
+
+		// blobs from before APTickets have no chip or board to check
+		if b.APTicket != nil {
+			ticket, err = b.apTicket()
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		verify = func(identity *BuildIdentity) *BlobVerification {
+			return b.verifyIMG3(ticket, identity)
+		}
+	}
+
+	var best *BlobVerification
+
+	for i := range manifest.BuildIdentities {
+		v := verify(&manifest.BuildIdentities[i])
+
+		if best == nil || v.score() > best.score() || (v.score() == best.score() && len(v.Missing) < len(best.Missing)) {
+			best = v
+		}
+	}
+
+	best.ECID = ecid
+	best.RestoreBehavior = best.Identity.Info.RestoreBehavior
+	best.Valid = best.ChipMatches && best.BoardMatches && len(best.Matched) > 0 && len(best.Mismatched) == 0 && len(best.Missing) == 0
+
+	return best, nil
+}
+
+func verifyIM4M(m *IM4M, identity *BuildIdentity) *BlobVerification {
+	v := &BlobVerification{Identity: identity}
+
+	chipID, err := strconv.ParseUint(identity.ApChipID, 0, 64)
+	v.ChipMatches = err == nil && chipID == m.ChipID
+
+	boardID, err := strconv.ParseUint(identity.ApBoardID, 0, 64)
+	v.BoardMatches = err == nil && boardID == m.BoardID
+
+	signed := make(map[string]bool)
+
+	for _, tag := range m.ComponentNames() {
+		component := m.Components[tag]
+
+		if component.Digest == nil {
+			continue
+		}
+
+		found := false
+
+		for name, entry := range identity.Manifest {
+			if bytes.Equal(entry.Digest, component.Digest) {
+				signed[name] = true
+				found = true
+			}
+		}
+
+		if !found {
+			v.Mismatched = append(v.Mismatched, tag)
+		}
+	}
+
+	for name, entry := range identity.Manifest {
+		if signed[name] {
+			v.Matched = append(v.Matched, name)
+		} else if entry.Trusted && entry.Digest != nil {
+			v.Missing = append(v.Missing, name)
+		}
+	}
+
+	sort.Strings(v.Matched)
+	sort.Strings(v.Missing)
+
+	return v
+}
+
+// apTicket parses the APTicket of an IMG3 blob, which is an IMG3 image or a run of its elements.
+func (b *SHSHBlob) apTicket() (*IMG3, error) {
+	r, err := NewIMG3Reader(bytes.NewReader(b.APTicket))
+
+	if err != nil {
+		return nil, err
+	}
+
+	ticket := new(IMG3)
+
+	if r.Header != nil {
+		ticket.ImageType = ElementType(r.Header.ImageType)
+	}
+
+	for {
+		elem, err := r.Next()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		ticket.Elements = append(ticket.Elements, elem)
+	}
+
+	return ticket, nil
+}
+
+// verifyIMG3 checks an IMG3 blob against identity. ticket is the blob's APTicket, or nil if it has none.
+func (b *SHSHBlob) verifyIMG3(ticket *IMG3, identity *BuildIdentity) *BlobVerification {
+	v := &BlobVerification{Identity: identity}
+
+	if ticket != nil {
+		chipID, err := ticket.ChipID()
+		identityChipID, identityErr := strconv.ParseUint(identity.ApChipID, 0, 32)
+		v.ChipMatches = err == nil && identityErr == nil && uint64(chipID) == identityChipID
+
+		boardID, err := ticket.BoardID()
+		identityBoardID, identityErr := strconv.ParseUint(identity.ApBoardID, 0, 32)
+		v.BoardMatches = err == nil && identityErr == nil && uint64(boardID) == identityBoardID
+	}
+
+	for name, component := range b.Components {
+		entry, ok := identity.Manifest[name]
+
+		if ok && component.PartialDigest != nil && bytes.Equal(entry.PartialDigest, component.PartialDigest) {
+			v.Matched = append(v.Matched, name)
+		} else {
+			v.Mismatched = append(v.Mismatched, name)
+		}
+	}
+
+	for name, entry := range identity.Manifest {
+		if _, ok := b.Components[name]; !ok && entry.PartialDigest != nil {
+			v.Missing = append(v.Missing, name)
+		}
+	}
+
+	sort.Strings(v.Matched)
+	sort.Strings(v.Mismatched)
+	sort.Strings(v.Missing)
+
+	return v
+}
+
+// VerifyBlob checks an SHSH blob against the BuildManifest of the IPSW.
+func (i *IPSW) VerifyBlob(blob *SHSHBlob) (*BlobVerification, error) {
+	return i.VerifyBlobContext(context.Background(), blob)
+}
+
+// VerifyBlobContext checks an SHSH blob against the BuildManifest of the IPSW, fetching it with ctx.
+func (i *IPSW) VerifyBlobContext(ctx context.Context, blob *SHSHBlob) (*BlobVerification, error) {
+	manifest, err := i.BuildManifestContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return blob.Verify(manifest)
+}
+
+// shsh2UpdateInstallKey holds the Update ticket of an .shsh2 blob.
+const shsh2UpdateInstallKey = "updateInstall"
+
+// ParseGenerator parses a nonce generator, e.g. 0x1111111111111111.
+func ParseGenerator(generator string) (uint64, error) {
+	g, err := strconv.ParseUint(generator, 0, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("ipsw: invalid generator '%s'", generator)
+	}
+
+	return g, nil
+}
+
+// FormatGenerator formats a nonce generator as it is saved in .shsh2 blobs.
+func FormatGenerator(generator uint64) string {
+	return fmt.Sprintf("0x%016x", generator)
+}
+
+// SetGenerator sets the generator the blob's ApNonce was derived from.
+func (b *SHSHBlob) SetGenerator(generator uint64) {
+	b.Generator = FormatGenerator(generator)
+}
+
+// ApNonce returns the ApNonce the blob was signed for. IMG3 blobs have none.
+func (b *SHSHBlob) ApNonce() ([]byte, error) {
+	m, err := b.IM4M()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m.ApNonce, nil
+}
+
+// CheckNonce checks that the ApNonce of the blob, and of its UpdateInstall ticket, is the one device derives from
+// the blob's Generator, returning a NonceMismatchError if not. Blobs without a generator, and IMG3 blobs, are not checked.
+func (b *SHSHBlob) CheckNonce(device *Device) error {
+	if b.Generator == "" || !b.IsIMG4() {
+		return nil
+	}
+
+	if device == nil {
+		return errors.New("ipsw: a device is needed to check the nonce of a blob")
+	}
+
+	generator, err := ParseGenerator(b.Generator)
+
+	if err != nil {
+		return err
+	}
+
+	want := GeneratorApNonce(generator, device.CPID)
+
+	for blob := b; blob != nil; blob = blob.UpdateInstall {
+		if !blob.IsIMG4() {
+			continue
+		}
+
+		nonce, err := blob.ApNonce()
+
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(nonce, want) {
+			return &NonceMismatchError{Generator: b.Generator, Expected: want, ApNonce: nonce}
+		}
+	}
+
+	return nil
+}
+
+// Bytes returns the blob as an .shsh2 plist, with the keys of Raw which have no field kept as they are.
+func (b *SHSHBlob) Bytes() ([]byte, error) {
+	return plist.MarshalIndent(b.plist(), plist.XMLFormat, "\t")
+}
+
+func (b *SHSHBlob) plist() map[string]interface{} {
+	out := make(map[string]interface{}, len(b.Raw)+4)
+
+	for key, value := range b.Raw {
+		out[key] = value
+	}
+
+	delete(out, "ApImg4Ticket")
+	delete(out, "APTicket")
+	delete(out, "BBTicket")
+	delete(out, "generator")
+	delete(out, shsh2UpdateInstallKey)
+
+	if b.APTicket != nil {
+		if b.IsIMG4() {
+			out["ApImg4Ticket"] = b.APTicket
+		} else {
+			out["APTicket"] = b.APTicket
+		}
+	}
+
+	if b.BBTicket != nil {
+		out["BBTicket"] = b.BBTicket
+	}
+
+	if b.Generator != "" {
+		out["generator"] = b.Generator
+	}
+
+	if b.UpdateInstall != nil {
+		out[shsh2UpdateInstallKey] = b.UpdateInstall.plist()
+	}
+
+	for name, component := range b.Components {
+		entry := map[string]interface{}{"Blob": component.Blob}
+
+		if component.Digest != nil {
+			entry["Digest"] = component.Digest
+		}
+
+		if component.PartialDigest != nil {
+			entry["PartialDigest"] = component.PartialDigest
+		}
+
+		out[name] = entry
+	}
+
+	return out
+}
+
+// WriteSHSH2 writes the blob to w as an .shsh2 plist, after checking its nonce against its generator for device.
+// See CheckNonce.
+func (b *SHSHBlob) WriteSHSH2(w io.Writer, device *Device) error {
+	if err := b.CheckNonce(device); err != nil {
+		return err
+	}
+
+	data, err := b.Bytes()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+
+	return err
+}
+
+// SaveSHSH2 writes the blob to the file at path. See WriteSHSH2. The file is only replaced once the blob
+// has been written in full.
+func (b *SHSHBlob) SaveSHSH2(path string, device *Device) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	err = f.Chmod(0644)
+
+	if err == nil {
+		err = b.WriteSHSH2(f, device)
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSHSHBlob reads the .shsh or .shsh2 blob at path.
+func LoadSHSHBlob(path string) (*SHSHBlob, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSHSHBlob(data)
+}
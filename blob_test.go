@@ -0,0 +1,120 @@
+package ipsw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testSHSH2Blob(t *testing.T, device *TSSDevice) *SHSHBlob {
+	t.Helper()
+
+	identity := testTSSIdentity("0x8030", "0x04")
+
+	client, done := testTSSClient(NewTSSServer(identity))
+	defer done()
+
+	req, err := NewTSSRequest(identity, device)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := client.RequestTicketContext(context.Background(), req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob.SetGenerator(device.Generator)
+
+	return blob
+}
+
+func TestSaveSHSH2(t *testing.T) {
+	blob := testSHSH2Blob(t, &TSSDevice{ECID: 0x1234, Generator: 0x1111111111111111})
+
+	dir, err := ioutil.TempDir("", "shsh2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "1234.shsh2")
+
+	if err := blob.SaveSHSH2(path, &Device{CPID: 0x8030}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadSHSHBlob(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Generator != "0x1111111111111111" || !bytes.Equal(loaded.APTicket, blob.APTicket) {
+		t.Fatalf("loaded blob %+v does not match the saved blob", loaded)
+	}
+
+	saved, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a blob which fails its nonce check must not replace the saved one
+	loaded.SetGenerator(0x2222222222222222)
+
+	if err := loaded.SaveSHSH2(path, &Device{CPID: 0x8030}); !errors.Is(err, ErrNonceMismatch) {
+		t.Fatalf("expected ErrNonceMismatch, got %v", err)
+	}
+
+	if err := loaded.SaveSHSH2(path, nil); err == nil {
+		t.Fatal("expected an error without a device")
+	}
+
+	after, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(saved, after) {
+		t.Fatal("a failed save changed the saved blob")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected only the saved blob in %s, got %d files, %v", dir, len(files), err)
+	}
+}
+
+func TestWriteSHSH2(t *testing.T) {
+	blob := testSHSH2Blob(t, &TSSDevice{ECID: 0x1234, Generator: 0x1111111111111111})
+	buf := new(bytes.Buffer)
+
+	if err := blob.WriteSHSH2(buf, nil); err == nil {
+		t.Fatal("expected an error without a device")
+	}
+
+	if err := blob.WriteSHSH2(buf, &Device{CPID: 0x8030}); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseSHSHBlob(buf.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parsed.CheckNonce(&Device{CPID: 0x8030}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,656 @@
+package ipsw
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheBlockSize is the size of the blocks remote files are cached in.
+	cacheBlockSize = 256 * 1024
+
+	cacheFileSuffix = ".cache"
+
+	// cacheTempPrefix starts the names of entries which are being written.
+	cacheTempPrefix = "tmp-"
+
+	// cacheTempMaxAge is how old an entry being written must be before it is taken to have been
+	// left by a run which crashed, rather than being written by another process using the directory.
+	cacheTempMaxAge = time.Hour
+)
+
+// Cache stores data fetched from remote files so that it does not have to be fetched again.
+// Implementations must be safe for concurrent use. Keys are opaque strings.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Put(key string, data []byte) error
+
+	// Delete removes key, if it is present.
+	Delete(key string) error
+}
+
+// DiskCache is a Cache which keeps entries as files in a directory, so that they
+// last across runs. Once the entries take up more than MaxSize bytes, the least
+// recently used entries are removed.
+type DiskCache struct {
+	Dir     string
+	MaxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+}
+
+type diskCacheEntry struct {
+	name string
+	size int64
+}
+
+// NewDiskCache opens the cache in dir, creating it if needed.
+// Entries left by earlier runs are kept, oldest first in line for eviction,
+// and entries which were still being written when a run crashed are removed.
+func NewDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	c := &DiskCache{
+		Dir:     dir,
+		MaxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), cacheTempPrefix) && time.Since(info.ModTime()) > cacheTempMaxAge {
+			if err := os.Remove(filepath.Join(dir, info.Name())); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if info.IsDir() || !strings.HasSuffix(info.Name(), cacheFileSuffix) {
+			continue
+		}
+
+		c.entries[info.Name()] = c.lru.PushBack(&diskCacheEntry{name: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c, c.evict()
+}
+
+func (c *DiskCache) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:]) + cacheFileSuffix
+}
+
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	name := c.filename(key)
+
+	c.mu.Lock()
+	elem, ok := c.entries[name]
+
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(c.Dir, name))
+
+	if err != nil {
+		c.remove(name)
+		return nil, false
+	}
+
+	// the modification time orders entries when the cache is next opened
+	now := time.Now()
+	_ = os.Chtimes(filepath.Join(c.Dir, name), now, now)
+
+	return data, true
+}
+
+func (c *DiskCache) Put(key string, data []byte) error {
+	if int64(len(data)) > c.MaxSize {
+		return nil
+	}
+
+	name := c.filename(key)
+
+	tmp, err := ioutil.TempFile(c.Dir, cacheTempPrefix)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), filepath.Join(c.Dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if elem, ok := c.entries[name]; ok {
+		entry := elem.Value.(*diskCacheEntry)
+		c.size += int64(len(data)) - entry.size
+		entry.size = int64(len(data))
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[name] = c.lru.PushFront(&diskCacheEntry{name: name, size: int64(len(data))})
+		c.size += int64(len(data))
+	}
+
+	return c.evict()
+}
+
+func (c *DiskCache) Delete(key string) error {
+	name := c.filename(key)
+
+	c.mu.Lock()
+	_, ok := c.entries[name]
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	c.remove(name)
+
+	if err := os.Remove(filepath.Join(c.Dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (c *DiskCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[name]; ok {
+		c.size -= elem.Value.(*diskCacheEntry).size
+		c.lru.Remove(elem)
+		delete(c.entries, name)
+	}
+}
+
+// evict removes the least recently used entries until the cache fits in MaxSize. c.mu must be held.
+func (c *DiskCache) evict() error {
+	for c.size > c.MaxSize && c.lru.Len() > 0 {
+		elem := c.lru.Back()
+		entry := elem.Value.(*diskCacheEntry)
+
+		if err := os.Remove(filepath.Join(c.Dir, entry.name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		c.size -= entry.size
+		c.lru.Remove(elem)
+		delete(c.entries, entry.name)
+	}
+
+	return nil
+}
+
+// Size returns the number of bytes held in the cache.
+func (c *DiskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// cachedSource is a remote Source whose data is kept in a Cache, in blocks of cacheBlockSize.
+// Entries are keyed by the URL and its ETag and Last-Modified headers, so a changed file is
+// fetched again. Files served without either header, or whose headers can't be fetched, are not cached.
+type cachedSource struct {
+	*httpSource
+
+	cache Cache
+
+	mu     sync.Mutex
+	probed bool
+	size   int64
+	prefix string
+}
+
+func newCachedSource(src *httpSource, cache Cache) *cachedSource {
+	return &cachedSource{httpSource: src, cache: cache}
+}
+
+// probe finds the size and validators of the file, once. If the HEAD request fails, the file is
+// read without the cache, as it would be if no cache was set. Only an error from ctx is returned.
+func (c *cachedSource) probe(ctx context.Context) (int64, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.probed {
+		return c.size, c.prefix, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.url.String(), nil)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	res, err := c.client.do(req)
+
+	if err == nil {
+		res.Body.Close()
+		err = checkResponse(c.url.String(), res)
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, "", err
+		}
+
+		c.client.logger().Log("unable to probe file, reading it without the cache", "url", c.url, "error", err)
+
+		c.size, c.prefix, c.probed = 0, "", true
+
+		return 0, "", nil
+	}
+
+	etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+
+	if res.ContentLength >= 0 && (etag != "" || lastModified != "") {
+		c.prefix = cacheKey(c.url, etag, lastModified)
+	}
+
+	c.size, c.probed = res.ContentLength, true
+
+	return c.size, c.prefix, nil
+}
+
+// reset discards everything cached for the file, along with the remote reader, so that a retry
+// after a bad read fetches the data again rather than reading the same blocks from the cache.
+func (c *cachedSource) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.prefix != "" {
+		for n := int64(0); n*cacheBlockSize < c.size; n++ {
+			c.delete(c.blockKey(c.prefix, n))
+		}
+
+		c.delete(c.directoryKey(c.prefix))
+	}
+
+	c.probed, c.size, c.prefix = false, 0, ""
+	c.httpSource.reset()
+}
+
+func (c *cachedSource) delete(key string) {
+	if err := c.cache.Delete(key); err != nil {
+		c.client.logger().Log("unable to remove cache entry", "url", c.url, "error", err)
+	}
+}
+
+func cacheKey(u *url.URL, etag, lastModified string) string {
+	return strings.Join([]string{u.String(), etag, lastModified}, "\x00")
+}
+
+func (c *cachedSource) Size(ctx context.Context) (int64, error) {
+	size, prefix, err := c.probe(ctx)
+
+	if err != nil || prefix == "" {
+		return c.httpSource.Size(ctx)
+	}
+
+	return size, nil
+}
+
+func (c *cachedSource) blockKey(prefix string, block int64) string {
+	return fmt.Sprintf("%s\x00block\x00%d", prefix, block)
+}
+
+// block returns block number n, fetching it if needed.
+func (c *cachedSource) block(ctx context.Context, prefix string, size, n int64) ([]byte, error) {
+	if data, ok := c.cache.Get(c.blockKey(prefix, n)); ok {
+		return data, nil
+	}
+
+	start := n * cacheBlockSize
+	end := start + cacheBlockSize
+
+	if end > size {
+		end = size
+	}
+
+	body, err := c.httpSource.Range(ctx, start, end-start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+
+	data := make([]byte, end-start)
+
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, err
+	}
+
+	if err := c.cache.Put(c.blockKey(prefix, n), data); err != nil {
+		c.client.logger().Log("unable to cache block", "url", c.url, "block", n, "error", err)
+	}
+
+	return data, nil
+}
+
+func (c *cachedSource) ReadAt(ctx context.Context, p []byte, off int64) (int, error) {
+	size, prefix, err := c.probe(ctx)
+
+	if err != nil {
+		return 0, err
+	} else if prefix == "" {
+		return c.httpSource.ReadAt(ctx, p, off)
+	}
+
+	n := 0
+
+	for n < len(p) {
+		pos := off + int64(n)
+
+		if pos >= size {
+			return n, io.EOF
+		}
+
+		data, err := c.block(ctx, prefix, size, pos/cacheBlockSize)
+
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], data[pos%cacheBlockSize:])
+	}
+
+	return n, nil
+}
+
+// Range serves the range from the cache if every block is present. Otherwise the range
+// is fetched with one request, and the blocks it covers are cached as they are read.
+func (c *cachedSource) Range(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+	size, prefix, err := c.probe(ctx)
+
+	if err != nil {
+		return nil, err
+	} else if prefix == "" {
+		return c.httpSource.Range(ctx, off, length)
+	}
+
+	first, last := off/cacheBlockSize, (off+length-1)/cacheBlockSize
+	blocks := make([][]byte, 0, last-first+1)
+
+	for n := first; n <= last; n++ {
+		data, ok := c.cache.Get(c.blockKey(prefix, n))
+
+		if !ok {
+			blocks = nil
+			break
+		}
+
+		blocks = append(blocks, data)
+	}
+
+	if blocks != nil {
+		r := io.MultiReader(bytesReaders(blocks)...)
+
+		if _, err := io.CopyN(ioutil.Discard, r, off-first*cacheBlockSize); err != nil {
+			return nil, err
+		}
+
+		return ioutil.NopCloser(io.LimitReader(r, length)), nil
+	}
+
+	start := first * cacheBlockSize
+	end := (last + 1) * cacheBlockSize
+
+	if end > size {
+		end = size
+	}
+
+	body, err := c.httpSource.Range(ctx, start, end-start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &blockCachingReader{
+		source: c,
+		prefix: prefix,
+		body:   body,
+		block:  first,
+		skip:   off - start,
+		remain: length,
+		buf:    make([]byte, 0, cacheBlockSize),
+		last:   end,
+	}, nil
+}
+
+func bytesReaders(blocks [][]byte) []io.Reader {
+	readers := make([]io.Reader, len(blocks))
+
+	for i, block := range blocks {
+		readers[i] = bytes.NewReader(block)
+	}
+
+	return readers
+}
+
+// blockCachingReader reads a range aligned to blocks, caching each block as it completes
+// and returning only the bytes which were asked for.
+type blockCachingReader struct {
+	source *cachedSource
+	prefix string
+	body   io.ReadCloser
+
+	block  int64 // number of the block in buf
+	buf    []byte
+	skip   int64 // bytes at the start which were not asked for
+	remain int64 // bytes asked for which have not been returned
+	last   int64 // end of the fetched range
+
+	pending []byte // bytes read but not yet returned
+}
+
+func (b *blockCachingReader) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if b.remain <= 0 {
+			return 0, io.EOF
+		}
+
+		want := cacheBlockSize - len(b.buf)
+
+		if end := b.block*cacheBlockSize + cacheBlockSize; end > b.last {
+			want = int(b.last - b.block*cacheBlockSize - int64(len(b.buf)))
+		}
+
+		n, err := b.body.Read(b.buf[len(b.buf) : len(b.buf)+want])
+		chunk := b.buf[len(b.buf) : len(b.buf)+n]
+		b.buf = b.buf[:len(b.buf)+n]
+
+		if skip := b.skip; skip > 0 {
+			if int64(len(chunk)) <= skip {
+				b.skip -= int64(len(chunk))
+				chunk = nil
+			} else {
+				chunk = chunk[skip:]
+				b.skip = 0
+			}
+		}
+
+		if int64(len(chunk)) > b.remain {
+			chunk = chunk[:b.remain]
+		}
+
+		b.pending = chunk
+		b.remain -= int64(len(chunk))
+
+		if n == want {
+			// the block is complete, so it can be cached and its buffer reused
+			if err := b.source.cache.Put(b.source.blockKey(b.prefix, b.block), append([]byte(nil), b.buf...)); err != nil {
+				b.source.client.logger().Log("unable to cache block", "url", b.source.url, "block", b.block, "error", err)
+			}
+
+			b.pending = append([]byte(nil), b.pending...)
+			b.buf = b.buf[:0]
+			b.block++
+		}
+
+		if err == io.EOF && b.remain > 0 && len(b.pending) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+
+	return n, nil
+}
+
+func (b *blockCachingReader) Close() error {
+	return b.body.Close()
+}
+
+// cachedRead is a read made while parsing a central directory.
+type cachedRead struct {
+	Offset int64
+	Data   []byte
+}
+
+// directoryCacher is a Source which can keep the reads needed to parse its central directory.
+type directoryCacher interface {
+	cachedDirectory(ctx context.Context) ([]cachedRead, bool)
+	storeDirectory(ctx context.Context, reads []cachedRead)
+}
+
+func (c *cachedSource) directoryKey(prefix string) string {
+	return prefix + "\x00directory"
+}
+
+func (c *cachedSource) cachedDirectory(ctx context.Context) ([]cachedRead, bool) {
+	_, prefix, err := c.probe(ctx)
+
+	if err != nil || prefix == "" {
+		return nil, false
+	}
+
+	data, ok := c.cache.Get(c.directoryKey(prefix))
+
+	if !ok {
+		return nil, false
+	}
+
+	var reads []cachedRead
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&reads); err != nil {
+		return nil, false
+	}
+
+	return reads, true
+}
+
+func (c *cachedSource) storeDirectory(ctx context.Context, reads []cachedRead) {
+	_, prefix, err := c.probe(ctx)
+
+	if err != nil || prefix == "" {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	if err := gob.NewEncoder(buf).Encode(reads); err != nil {
+		return
+	}
+
+	if err := c.cache.Put(c.directoryKey(prefix), buf.Bytes()); err != nil {
+		c.client.logger().Log("unable to cache central directory", "url", c.url, "error", err)
+	}
+}
+
+// directorySource serves reads from a cached central directory, falling back to the Source.
+// While recording, the reads it passes on are kept so that they can be cached.
+type directorySource struct {
+	Source
+
+	mu        sync.Mutex
+	reads     []cachedRead
+	recording bool
+}
+
+func (d *directorySource) ReadAt(ctx context.Context, p []byte, off int64) (int, error) {
+	d.mu.Lock()
+
+	for _, read := range d.reads {
+		if off >= read.Offset && off+int64(len(p)) <= read.Offset+int64(len(read.Data)) {
+			d.mu.Unlock()
+			return copy(p, read.Data[off-read.Offset:]), nil
+		}
+	}
+
+	d.mu.Unlock()
+
+	n, err := d.Source.ReadAt(ctx, p, off)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.recording && n > 0 {
+		d.reads = append(d.reads, cachedRead{Offset: off, Data: append([]byte(nil), p[:n]...)})
+	}
+
+	return n, err
+}
@@ -0,0 +1,224 @@
+package ipsw
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryCache is a Cache held in a map.
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func (m *memoryCache) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.entries[key]
+
+	return data, ok
+}
+
+func (m *memoryCache) Put(key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.entries == nil {
+		m.entries = make(map[string][]byte)
+	}
+
+	m.entries[key] = data
+
+	return nil
+}
+
+func (m *memoryCache) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+
+	return nil
+}
+
+func (m *memoryCache) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.entries)
+}
+
+// testCacheServer serves content with an ETag, counting the requests of each method.
+type testCacheServer struct {
+	content []byte
+	head    bool
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (s *testCacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+
+	if s.requests == nil {
+		s.requests = make(map[string]int)
+	}
+
+	s.requests[r.Method]++
+	s.mu.Unlock()
+
+	if r.Method == http.MethodHead && !s.head {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("ETag", `"1"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content))
+}
+
+func (s *testCacheServer) count(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[method]
+}
+
+func testCachedSource(t *testing.T, s *testCacheServer, cache Cache) (*cachedSource, func()) {
+	t.Helper()
+
+	server := httptest.NewServer(s)
+	client := &Client{Cache: cache, Logger: discardLogger}
+
+	src, err := client.NewHTTPSource(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return src.(*cachedSource), server.Close
+}
+
+func TestCachedSourceHeadRejected(t *testing.T) {
+	s := &testCacheServer{content: bytes.Repeat([]byte("0123456789abcdef"), 1024)}
+	cache := &memoryCache{}
+
+	src, done := testCachedSource(t, s, cache)
+	defer done()
+
+	for i := 0; i < 2; i++ {
+		p := make([]byte, 16)
+
+		if _, err := src.ReadAt(context.Background(), p, 32); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(p) != "0123456789abcdef" {
+			t.Fatalf("read %q", p)
+		}
+	}
+
+	if n := s.count(http.MethodHead); n != 1 {
+		t.Fatalf("expected the failed HEAD to be made once, got %d", n)
+	}
+
+	if cache.len() != 0 {
+		t.Fatalf("expected nothing to be cached, got %d entries", cache.len())
+	}
+}
+
+func TestCachedSourceReset(t *testing.T) {
+	s := &testCacheServer{content: bytes.Repeat([]byte("0123456789abcdef"), cacheBlockSize/8), head: true}
+	cache := &memoryCache{}
+
+	src, done := testCachedSource(t, s, cache)
+	defer done()
+
+	p := make([]byte, 16)
+
+	if _, err := src.ReadAt(context.Background(), p, cacheBlockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	_, prefix, _ := src.probe(context.Background())
+
+	// spoil the cached block, as a bad response would have
+	cache.Put(src.blockKey(prefix, 1), make([]byte, cacheBlockSize))
+	cache.Put(src.directoryKey(prefix), []byte("bad directory"))
+
+	src.reset()
+
+	if cache.len() != 0 {
+		t.Fatalf("expected reset to empty the cache, got %d entries", cache.len())
+	}
+
+	if _, err := src.ReadAt(context.Background(), p, cacheBlockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p) != "0123456789abcdef" {
+		t.Fatalf("read %q after reset", p)
+	}
+
+	if n := s.count(http.MethodHead); n != 2 {
+		t.Fatalf("expected the file to be probed again after reset, got %d HEAD requests", n)
+	}
+}
+
+func TestDiskCacheRemovesTemporaryFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	stale, fresh := filepath.Join(dir, cacheTempPrefix+"1"), filepath.Join(dir, cacheTempPrefix+"2")
+
+	for _, name := range []string{stale, fresh} {
+		if err := ioutil.WriteFile(name, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-2 * cacheTempMaxAge)
+
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewDiskCache(dir, 1<<20)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale temporary file to be removed, got %v", err)
+	}
+
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("expected the temporary file being written to be kept, got %v", err)
+	}
+
+	if err := cache.Put("key", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cache.Get("key"); ok || cache.Size() != 0 {
+		t.Fatalf("expected the deleted entry to be gone, cache holds %d bytes", cache.Size())
+	}
+}
@@ -0,0 +1,222 @@
+package ipsw
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Client holds everything used to fetch firmware and its metadata. The zero value uses
+// DefaultClient, DefaultRetryPolicy and the log package. A Client is safe for concurrent use,
+// but must not be modified once in use.
+//
+// The package level functions, such as DownloadFile and NewOTAXML, use a Client made from
+// DefaultClient and MaxDownloadTries at the time of the call.
+type Client struct {
+	// HTTPClient makes every request. Defaults to DefaultClient.
+	HTTPClient HTTPClient
+
+	// Retry decides how failed downloads are retried. Defaults to DefaultRetryPolicy.
+	Retry *RetryPolicy
+
+	// UserAgent, if set, is sent with every request which does not set its own, such as those to TSS.
+	UserAgent string
+
+	// Logger receives retries and other diagnostics. Defaults to the log package.
+	Logger Logger
+
+	// Cache, if set, keeps the parts of remote files which have been read, such as
+	// central directories and manifests, so they are not fetched again. See DiskCache.
+	Cache Cache
+
+	// TSSURL is the TSS server personalisation requests are sent to. Defaults to DefaultTSSURL.
+	TSSURL string
+}
+
+// NewClient creates a Client which makes requests with httpClient.
+func NewClient(httpClient HTTPClient) *Client {
+	return &Client{HTTPClient: httpClient}
+}
+
+// defaultClient is the Client behind the package level functions.
+func defaultClient() *Client {
+	return &Client{}
+}
+
+func (c *Client) tssURL() string {
+	if c.TSSURL == "" {
+		return DefaultTSSURL
+	}
+
+	return c.TSSURL
+}
+
+func (c *Client) httpClient() HTTPClient {
+	if c.HTTPClient == nil {
+		return DefaultClient
+	}
+
+	return c.HTTPClient
+}
+
+// options fills in anything not set in opts from the client.
+func (c *Client) options(opts *DownloadOptions) *DownloadOptions {
+	merged := &DownloadOptions{Retry: c.Retry, Logger: c.Logger}
+
+	if opts != nil && opts.Retry != nil {
+		merged.Retry = opts.Retry
+	}
+
+	if opts != nil && opts.Logger != nil {
+		merged.Logger = opts.Logger
+	}
+
+	return merged
+}
+
+func (c *Client) logger() Logger {
+	return c.options(nil).logger()
+}
+
+// do makes req, adding the client's user agent.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	c.setUserAgent(req)
+
+	return c.httpClient().Do(req)
+}
+
+// setUserAgent sets the client's user agent on req, unless req already has one.
+func (c *Client) setUserAgent(req *http.Request) {
+	if c.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+}
+
+// get makes a GET request to url with ctx. Responses other than 2xx are returned as an HTTPStatusError.
+func (c *Client) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(url, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// fetchRange requests bytes [start, end) of resource.
+func (c *Client) fetchRange(ctx context.Context, resource string, start, end int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resource, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	res, err := c.do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+
+		return nil, newHTTPStatusError(resource, res)
+	}
+
+	return res.Body, nil
+}
+
+// stream requests resource from offset onwards, for bodies which may take longer to read than the
+// timeout of the client's *http.Client. The timeout instead limits how long the response may go
+// without any data arriving. The offset the body starts from is returned, which is 0 if the server
+// ignored the range.
+func (c *Client) stream(ctx context.Context, resource string, offset int64) (io.ReadCloser, int64, error) {
+	httpClient := c.httpClient()
+
+	var timeout time.Duration
+
+	if hc, ok := httpClient.(*http.Client); ok && hc.Timeout > 0 {
+		unbounded := *hc
+		unbounded.Timeout = 0
+
+		httpClient, timeout = &unbounded, hc.Timeout
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	body := newStallReader(cancel, timeout)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resource, nil)
+
+	if err != nil {
+		body.Close()
+		return nil, 0, err
+	}
+
+	c.setUserAgent(req)
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	res, err := httpClient.Do(req)
+
+	if err != nil {
+		body.Close()
+		return nil, 0, body.err(err)
+	}
+
+	if err := checkResponse(resource, res); err != nil {
+		body.Close()
+		return nil, 0, err
+	}
+
+	if res.StatusCode != http.StatusPartialContent {
+		offset = 0
+	}
+
+	body.rc = res.Body
+
+	return body, offset, nil
+}
+
+// NewIPSW creates an IPSW which is fetched with the client.
+func (c *Client) NewIPSW(identifier, build, resource string) *IPSW {
+	i := NewIPSW(identifier, build, resource)
+	i.client = c
+
+	return i
+}
+
+// NewIPSWWithSource creates an IPSW which is read from src, retrying with the client's settings.
+func (c *Client) NewIPSWWithSource(identifier, build string, src Source) *IPSW {
+	i := NewIPSWWithSource(identifier, build, src)
+	i.client = c
+
+	return i
+}
+
+// NewOTAZip creates an OTAZip which is fetched with the client.
+func (c *Client) NewOTAZip(identifier, build, resource string) *OTAZip {
+	return &OTAZip{
+		IPSW: c.NewIPSW(identifier, build, resource),
+	}
+}
+
+// NewDownloader creates a Downloader which fetches files with the client.
+func (c *Client) NewDownloader() *Downloader {
+	return &Downloader{Client: c}
+}
@@ -0,0 +1,190 @@
+package ipsw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+)
+
+const (
+	lzssMagic      = "complzss"
+	lzssHeaderSize = 0x180
+
+	lzssRingSize  = 4096
+	lzssMaxMatch  = 18
+	lzssThreshold = 2
+)
+
+// CompressionFormat is the compression of a firmware payload, as detected from its header.
+type CompressionFormat int
+
+const (
+	UncompressedFormat CompressionFormat = iota
+	LZSSFormat
+	LZFSEFormat
+	LZVNFormat
+)
+
+func (c CompressionFormat) String() string {
+	switch c {
+	case UncompressedFormat:
+		return "none"
+	case LZSSFormat:
+		return "lzss"
+	case LZFSEFormat:
+		return "lzfse"
+	case LZVNFormat:
+		return "lzvn"
+	default:
+		return fmt.Sprintf("CompressionFormat(%d)", int(c))
+	}
+}
+
+// DetectCompression returns the compression of data from its header.
+// LZFSE streams may contain LZVN and uncompressed blocks, so are detected as LZFSE unless they start with an LZVN block.
+func DetectCompression(data []byte) CompressionFormat {
+	switch {
+	case bytes.HasPrefix(data, []byte(lzssMagic)):
+		return LZSSFormat
+	case bytes.HasPrefix(data, []byte(lzvnBlockMagic)):
+		return LZVNFormat
+	case bytes.HasPrefix(data, []byte(lzfseV2BlockMagic)), bytes.HasPrefix(data, []byte(lzfseV1BlockMagic)),
+		bytes.HasPrefix(data, []byte(lzfseRawBlockMagic)):
+		return LZFSEFormat
+	default:
+		return UncompressedFormat
+	}
+}
+
+// Decompress decompresses data, detecting its compression from its header.
+// Data which is not compressed is returned as it is.
+func Decompress(data []byte) ([]byte, error) {
+	switch DetectCompression(data) {
+	case LZSSFormat:
+		return DecompressLZSS(data)
+	case LZFSEFormat, LZVNFormat:
+		return DecompressLZFSE(data)
+	default:
+		return data, nil
+	}
+}
+
+// Payload returns the contents of the IM4P, decrypted with key if it is not nil, then decompressed.
+// For a kernelcache, this is its Mach-O.
+func (p *IM4P) Payload(key *ImageKey) ([]byte, error) {
+	data := p.Data
+
+	if key != nil {
+		var err error
+
+		data, err = p.Decrypt(key)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := Decompress(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Compression != nil && p.Compression.UncompressedSize != 0 && p.Compression.UncompressedSize != len(out) {
+		return nil, im4pError("decompressed to %d bytes, expected %d", len(out), p.Compression.UncompressedSize)
+	}
+
+	return out, nil
+}
+
+func lzssError(format string, args ...interface{}) error {
+	return &ImageFormatError{Format: "LZSS", Err: fmt.Errorf(format, args...)}
+}
+
+// DecompressLZSS decompresses a complzss payload, as used by older kernelcaches.
+func DecompressLZSS(data []byte) ([]byte, error) {
+	if len(data) < lzssHeaderSize || !bytes.HasPrefix(data, []byte(lzssMagic)) {
+		return nil, lzssError("bad header")
+	}
+
+	checksum := binary.BigEndian.Uint32(data[8:])
+	size := binary.BigEndian.Uint32(data[12:])
+	compressedSize := binary.BigEndian.Uint32(data[16:])
+
+	if uint64(compressedSize) > uint64(len(data)-lzssHeaderSize) {
+		return nil, lzssError("compressed size %d is larger than the payload", compressedSize)
+	}
+
+	// each flag byte is followed by at most eight matches of two bytes, which is the most the data can grow
+	if maxSize := (uint64(compressedSize)/(1+8*2) + 1) * 8 * lzssMaxMatch; uint64(size) > maxSize {
+		return nil, lzssError("size %d is more than %d compressed bytes can hold", size, compressedSize)
+	}
+
+	out := decompressLZSS(data[lzssHeaderSize:lzssHeaderSize+compressedSize], int(size))
+
+	if len(out) != int(size) {
+		return nil, lzssError("decompressed to %d bytes, expected %d", len(out), size)
+	}
+
+	if checksum != 0 && adler32.Checksum(out) != checksum {
+		return nil, lzssError("checksum mismatch")
+	}
+
+	return out, nil
+}
+
+// decompressLZSS decompresses a raw LZSS stream, stopping after size bytes.
+func decompressLZSS(src []byte, size int) []byte {
+	var ring [lzssRingSize]byte
+
+	for i := range ring[:lzssRingSize-lzssMaxMatch] {
+		ring[i] = ' '
+	}
+
+	out := make([]byte, 0, size)
+	r := lzssRingSize - lzssMaxMatch
+	flags := 0
+
+	for len(src) > 0 && len(out) < size {
+		flags >>= 1
+
+		if flags&0x100 == 0 {
+			flags = int(src[0]) | 0xff00
+			src = src[1:]
+		}
+
+		if flags&1 == 1 {
+			if len(src) < 1 {
+				break
+			}
+
+			c := src[0]
+			src = src[1:]
+
+			out = append(out, c)
+			ring[r] = c
+			r = (r + 1) & (lzssRingSize - 1)
+
+			continue
+		}
+
+		if len(src) < 2 {
+			break
+		}
+
+		i := int(src[0]) | int(src[1]&0xf0)<<4
+		j := int(src[1]&0x0f) + lzssThreshold
+		src = src[2:]
+
+		for k := 0; k <= j && len(out) < size; k++ {
+			c := ring[(i+k)&(lzssRingSize-1)]
+
+			out = append(out, c)
+			ring[r] = c
+			r = (r + 1) & (lzssRingSize - 1)
+		}
+	}
+
+	return out
+}
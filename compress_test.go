@@ -0,0 +1,166 @@
+package ipsw
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// compressTestData is the contents of every compressed fixture below.
+var compressTestData = strings.Repeat("The quick brown fox jumps over the lazy dog. ", 6)
+
+const (
+	// rawFixture is compressTestData in an uncompressed LZFSE block.
+	rawFixture = "6276782d0e010000" + "54686520717569636b2062726f776e20666f78206a756d7073206f76657220746865206c617a7920646f672e20" +
+		"54686520717569636b2062726f776e20666f78206a756d7073206f76657220746865206c617a7920646f672e20" +
+		"54686520717569636b2062726f776e20666f78206a756d7073206f76657220746865206c617a7920646f672e20" +
+		"54686520717569636b2062726f776e20666f78206a756d7073206f76657220746865206c617a7920646f672e20" +
+		"54686520717569636b2062726f776e20666f78206a756d7073206f76657220746865206c617a7920646f672e20" +
+		"54686520717569636b2062726f776e20666f78206a756d7073206f76657220746865206c617a7920646f672e20" +
+		"62767824"
+
+	// lzvnFixture is compressTestData as 45 literals, a match of 10 at distance 45 and a match of 215.
+	lzvnFixture = "6276786e0e0100003b000000" +
+		"e01d54686520717569636b2062726f776e20666f78206a756d7073206f76657220746865206c617a7920646f672e20" +
+		"382df0c7060000000000000062767824"
+
+	// lzfseV2Fixture is compressTestData in a single compressed LZFSE v2 block.
+	lzfseV2Fixture = "627678320e0100003000400200020030261198da330b00509f000000208000088f00000000008f008f00000000008f00" +
+		"8f060000008f060000000000000000000000008f0200000000000000f0b2000000700d0000000000000000c0350000c0" +
+		"f5f5f5f5a3707dfd125c5f5f5f5f5f7f0fd7d72fc1f5f54b707d7d7d7d0d000000000000000000000000000000000000" +
+		"0000000000000000000000000000000000000000000000000000b0a145b011b5769653d3ef4a0236e615fdee93f07678" +
+		"891302000000000000000088541162767824"
+
+	// lzssFixture is the LZSS stream of compressTestData, without its complzss header.
+	lzssFixture = "ff5468652071756963ff6b2062726f776e20ff666f78206a756d70ff73206f7665722074feeff06c617a7920646f07" +
+		"672e20eeff000f120f240f360f00480f5a0f6c0f7e0f900fa20fb40fc606"
+	lzssFixtureChecksum = 0x81c060eb
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// complzss wraps an LZSS stream in a complzss header.
+func complzss(checksum uint32, size int, stream []byte) []byte {
+	header := make([]byte, lzssHeaderSize)
+	copy(header, lzssMagic)
+	binary.BigEndian.PutUint32(header[8:], checksum)
+	binary.BigEndian.PutUint32(header[12:], uint32(size))
+	binary.BigEndian.PutUint32(header[16:], uint32(len(stream)))
+
+	return append(header, stream...)
+}
+
+func TestDecompressKnownAnswers(t *testing.T) {
+	lzss := complzss(lzssFixtureChecksum, len(compressTestData), mustDecodeHex(t, lzssFixture))
+	lzvn := mustDecodeHex(t, lzvnFixture)
+	raw := mustDecodeHex(t, rawFixture)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		format CompressionFormat
+		want   string
+	}{
+		{"bvx-", raw, LZFSEFormat, compressTestData},
+		{"bvxn", lzvn, LZVNFormat, compressTestData},
+		{"bvx2", mustDecodeHex(t, lzfseV2Fixture), LZFSEFormat, compressTestData},
+		{"complzss", lzss, LZSSFormat, compressTestData},
+		{"bvxn then bvx-", append(append([]byte{}, lzvn[:len(lzvn)-4]...), raw...), LZVNFormat, compressTestData + compressTestData},
+		{"uncompressed", []byte("not compressed"), UncompressedFormat, "not compressed"},
+	}
+
+	for _, test := range tests {
+		if format := DetectCompression(test.data); format != test.format {
+			t.Errorf("%s: detected %s, expected %s", test.name, format, test.format)
+		}
+
+		out, err := Decompress(test.data)
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if string(out) != test.want {
+			t.Errorf("%s: decompressed to %q, expected %q", test.name, out, test.want)
+		}
+	}
+}
+
+func TestDecompressLZVN(t *testing.T) {
+	stream := mustDecodeHex(t, lzvnFixture)[lzvnHeaderSize:]
+
+	out, err := DecompressLZVN(stream, len(compressTestData))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != compressTestData {
+		t.Fatalf("decompressed to %q", out)
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	lzfse := mustDecodeHex(t, lzfseV2Fixture)
+	lzvn := mustDecodeHex(t, lzvnFixture)
+	lzss := complzss(lzssFixtureChecksum, len(compressTestData), mustDecodeHex(t, lzssFixture))
+
+	badChecksum := complzss(lzssFixtureChecksum^1, len(compressTestData), mustDecodeHex(t, lzssFixture))
+	badDistance := append([]byte{}, lzvn...)
+	badDistance[lzvnHeaderSize+48] = 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"bvx2 truncated", lzfse[:len(lzfse)/2]},
+		{"bvx2 without bvx$", lzfse[:len(lzfse)-4]},
+		{"bvxn without bvx$", lzvn[:len(lzvn)-4]},
+		{"bvxn distance before start", badDistance},
+		{"bvx- truncated", []byte("bvx-\xff\x00\x00\x00xyz")},
+		{"unknown block", append(append([]byte{}, lzvn[:len(lzvn)-4]...), "bvx?\x00\x00\x00\x00"...)},
+		{"complzss truncated", lzss[:lzssHeaderSize+10]},
+		{"complzss bad checksum", badChecksum},
+		{"complzss short header", lzss[:lzssHeaderSize-1]},
+	}
+
+	for _, test := range tests {
+		if _, err := Decompress(test.data); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if !errors.Is(err, ErrBadImage) {
+			t.Errorf("%s: %v is not ErrBadImage", test.name, err)
+		}
+	}
+}
+
+func TestDecompressLZSSSize(t *testing.T) {
+	stream := mustDecodeHex(t, lzssFixture)
+
+	// a size the stream could never decompress to must be refused before anything is allocated for it
+	for _, size := range []int{1 << 31, 1 << 20} {
+		_, err := DecompressLZSS(complzss(0, size, stream))
+
+		if !errors.Is(err, ErrBadImage) {
+			t.Errorf("size %d: expected ErrBadImage, got %v", size, err)
+		}
+	}
+
+	out, err := DecompressLZSS(complzss(0, len(compressTestData), stream))
+
+	if err != nil || string(out) != compressTestData {
+		t.Fatalf("unchecked checksum: %q, %v", out, err)
+	}
+}
@@ -0,0 +1,206 @@
+package ipsw
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// ImageKey is the AES key and IV for the payload of an IMG3 or IM4P.
+type ImageKey struct {
+	Key []byte
+	IV  []byte
+}
+
+// NewImageKey parses a hex key and IV. The key can be 128, 192 or 256 bits.
+// If iv is empty, key is taken to be the IV followed by the key, as KBag returns them.
+func NewImageKey(key, iv string) (*ImageKey, error) {
+	key, iv = strings.TrimSpace(key), strings.TrimSpace(iv)
+
+	if iv == "" && len(key) > 2*aes.BlockSize {
+		key, iv = key[2*aes.BlockSize:], key[:2*aes.BlockSize]
+	}
+
+	k, err := hex.DecodeString(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("ipsw: invalid key: %w", err)
+	}
+
+	v, err := hex.DecodeString(iv)
+
+	if err != nil {
+		return nil, fmt.Errorf("ipsw: invalid iv: %w", err)
+	}
+
+	switch len(k) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("ipsw: invalid key length %d", len(k))
+	}
+
+	if len(v) != aes.BlockSize {
+		return nil, fmt.Errorf("ipsw: invalid iv length %d", len(v))
+	}
+
+	return &ImageKey{Key: k, IV: v}, nil
+}
+
+// ImageKeyFromFirmwareKey returns the key and IV of a key from the api.
+func ImageKeyFromFirmwareKey(key *api.FirmwareKey) (*ImageKey, error) {
+	return NewImageKey(key.Key, key.IV)
+}
+
+// DecryptAESCBC decrypts data with AES-CBC. Any partial block at the end of data is not encrypted,
+// so is copied as it is.
+func DecryptAESCBC(data []byte, key *ImageKey) ([]byte, error) {
+	block, err := aes.NewCipher(key.Key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key.IV) != aes.BlockSize {
+		return nil, fmt.Errorf("ipsw: invalid iv length %d", len(key.IV))
+	}
+
+	out := make([]byte, len(data))
+	n := len(data) - len(data)%aes.BlockSize
+
+	cipher.NewCBCDecrypter(block, key.IV).CryptBlocks(out[:n], data[:n])
+	copy(out[n:], data[n:])
+
+	return out, nil
+}
+
+// payloadMagics are found at the start of decrypted payloads.
+var payloadMagics = [][]byte{
+	[]byte("complzss"),
+	[]byte("bvx2"),
+	[]byte("bvx1"),
+	[]byte("bvx-"),
+	[]byte("bvxn"),
+	[]byte("iBootIm"),
+	[]byte("Img3"),
+	[]byte("3gmI"),
+	{0xce, 0xfa, 0xed, 0xfe}, // mach-o
+	{0xcf, 0xfa, 0xed, 0xfe}, // mach-o 64
+	{0xfe, 0xed, 0xfa, 0xce},
+	{0xfe, 0xed, 0xfa, 0xcf},
+}
+
+// payloadOffsetMagics are found part way into decrypted payloads: iBoot's name, and the HFS+ volume header of ramdisks.
+var payloadOffsetMagics = []struct {
+	offset int
+	magic  []byte
+}{
+	{0x200, []byte("iBoot")},
+	{0x200, []byte("iBEC")},
+	{0x200, []byte("iBSS")},
+	{0x200, []byte("LLB")},
+	{0x280, []byte("iBoot")},
+	{0x280, []byte("iBEC")},
+	{0x280, []byte("iBSS")},
+	{0x280, []byte("LLB")},
+	{0x400, []byte("H+")},
+	{0x400, []byte("HX")},
+}
+
+// checkedPayloadTypes are the image types whose decrypted payloads always start with a known magic.
+// Payloads of other types, such as SEP firmware, can start with anything, so are not checked.
+var checkedPayloadTypes = map[string]bool{
+	"krnl": true,
+	"ibot": true,
+	"ibss": true,
+	"ibec": true,
+	"illb": true,
+	"rdsk": true,
+	"logo": true,
+}
+
+// checkPayload returns a DecryptionError if data, the payload of an image of imageType,
+// doesn't start as a known payload.
+func checkPayload(format, imageType string, data []byte) error {
+	if !checkedPayloadTypes[imageType] {
+		return nil
+	}
+
+	for _, magic := range payloadMagics {
+		if bytes.HasPrefix(data, magic) {
+			return nil
+		}
+	}
+
+	for _, m := range payloadOffsetMagics {
+		if len(data) > m.offset && bytes.HasPrefix(data[m.offset:], m.magic) {
+			return nil
+		}
+	}
+
+	magic := data
+
+	if len(magic) > 8 {
+		magic = magic[:8]
+	}
+
+	return &DecryptionError{Format: format, Type: imageType, Magic: magic}
+}
+
+// Decrypt decrypts the payload of the IM4P with key. If the payload of a kernel, bootloader, ramdisk or logo
+// is not recognised once decrypted, a DecryptionError is returned along with the decrypted payload, as the
+// key is likely to be wrong.
+func (p *IM4P) Decrypt(key *ImageKey) ([]byte, error) {
+	data, err := DecryptAESCBC(p.Data, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, checkPayload(IM4PMagic, p.Type, data)
+}
+
+// DecryptIM4P parses an IM4P and decrypts its payload. See IM4P.Decrypt.
+func DecryptIM4P(data []byte, key *ImageKey) ([]byte, error) {
+	im4p, err := ParseIM4P(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return im4p.Decrypt(key)
+}
+
+// DecryptIMG3 decrypts the DATA element of an IMG3. If the payload of a kernel, bootloader, ramdisk or logo
+// is not recognised once decrypted, a DecryptionError is returned along with the decrypted payload, as the
+// key is likely to be wrong.
+func DecryptIMG3(data []byte, key *ImageKey) ([]byte, error) {
+	img3, err := ParseIMG3(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return img3.Decrypt(key)
+}
+
+// Decrypt decrypts the DATA element of the image. See DecryptIMG3.
+func (i *IMG3) Decrypt(key *ImageKey) ([]byte, error) {
+	elem, err := i.Element(DataElement)
+
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := DecryptAESCBC(elem.Data, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypted, checkPayload("IMG3", i.ImageType.String(), decrypted)
+}
@@ -0,0 +1,136 @@
+package ipsw
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestDecryptAESCBC(t *testing.T) {
+	// the first block of the CBC decryption examples of NIST SP 800-38A, F.2.2 and F.2.6,
+	// followed by a partial block which is not encrypted
+	for _, c := range []struct {
+		key, ciphertext string
+	}{
+		{"2b7e151628aed2a6abf7158809cf4f3c", "7649abac8119b246cee98e9b12e9197d"},
+		{"603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4", "f58c4c04d6e5f1ba779eabfb5f7bfbd6"},
+	} {
+		key, err := NewImageKey(c.key, "000102030405060708090a0b0c0d0e0f")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ciphertext, _ := hex.DecodeString(c.ciphertext + "ffff")
+
+		plaintext, err := DecryptAESCBC(ciphertext, key)
+
+		if want := "6bc1bee22e409f96e93d7e117393172affff"; err != nil || hex.EncodeToString(plaintext) != want {
+			t.Errorf("AES-%d decrypted to %x, %v, expected %s", 8*len(key.Key), plaintext, err, want)
+		}
+	}
+}
+
+func TestNewImageKey(t *testing.T) {
+	// as KBag returns it, the IV followed by the key
+	key, err := NewImageKey("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", "")
+
+	if err != nil || key.IV[0] != 0x00 || key.Key[0] != 0x10 || len(key.Key) != 16 {
+		t.Fatalf("parsed key %+v, %v", key, err)
+	}
+
+	for _, c := range []struct{ key, iv string }{
+		{"0011", "000102030405060708090a0b0c0d0e0f"},
+		{"2b7e151628aed2a6abf7158809cf4f3c", "0001"},
+		{"not hex", "000102030405060708090a0b0c0d0e0f"},
+	} {
+		if _, err := NewImageKey(c.key, c.iv); err == nil {
+			t.Errorf("expected an error for key %s and iv %s", c.key, c.iv)
+		}
+	}
+}
+
+// testEncrypt encrypts data with AES-CBC, leaving any partial block at the end as it is.
+func testEncrypt(data []byte, key *ImageKey) []byte {
+	block, err := aes.NewCipher(key.Key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	out := append([]byte(nil), data...)
+	n := len(data) - len(data)%aes.BlockSize
+
+	cipher.NewCBCEncrypter(block, key.IV).CryptBlocks(out[:n], data[:n])
+
+	return out
+}
+
+func TestDecryptImages(t *testing.T) {
+	payload := append([]byte("complzss"), bytes.Repeat([]byte{0xaa}, 27)...)
+
+	wrong, err := NewImageKey("ffffffffffffffffffffffffffffffff", "000102030405060708090a0b0c0d0e0f")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"2b7e151628aed2a6abf7158809cf4f3c", "603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4"} {
+		key, err := NewImageKey(k, "000102030405060708090a0b0c0d0e0f")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encrypted := testEncrypt(payload, key)
+
+		img3 := &IMG3{ImageType: ElementType(0x6b726e6c)}
+		img3.SetElement(DataElement, encrypted)
+
+		im4p, err := asn1.Marshal(struct {
+			Magic       string `asn1:"ia5"`
+			Type        string `asn1:"ia5"`
+			Description string `asn1:"ia5"`
+			Data        []byte
+		}{IM4PMagic, "krnl", "KernelCache", encrypted})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for format, decrypt := range map[string]func(*ImageKey) ([]byte, error){
+			"IMG3": func(k *ImageKey) ([]byte, error) { return DecryptIMG3(img3.Bytes(), k) },
+			"IM4P": func(k *ImageKey) ([]byte, error) { return DecryptIM4P(im4p, k) },
+		} {
+			decrypted, err := decrypt(key)
+
+			if err != nil || !bytes.Equal(decrypted, payload) {
+				t.Errorf("%s with AES-%d decrypted to %x, %v", format, 8*len(key.Key), decrypted, err)
+			}
+
+			decrypted, err = decrypt(wrong)
+
+			var decryptionErr *DecryptionError
+
+			if !errors.Is(err, ErrBadKey) || !errors.As(err, &decryptionErr) {
+				t.Fatalf("%s with the wrong key: expected a DecryptionError, got %v", format, err)
+			}
+
+			if decryptionErr.Format != format || decryptionErr.Type != "krnl" || !bytes.Equal(decryptionErr.Magic, decrypted[:8]) {
+				t.Errorf("%s with the wrong key returned %+v", format, decryptionErr)
+			}
+		}
+	}
+
+	// payloads of other types are not checked
+	sep := &IMG3{ImageType: ElementType(0x73657069)}
+	sep.SetElement(DataElement, payload)
+
+	if _, err := sep.Decrypt(wrong); err != nil {
+		t.Fatalf("expected no check of a sepi payload, got %v", err)
+	}
+}
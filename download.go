@@ -0,0 +1,639 @@
+package ipsw
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+const (
+	defaultDownloadConnections = 4
+
+	partialDownloadSuffix = ".part"
+	downloadStateSuffix   = ".part.json"
+)
+
+// Checksums are the expected digests of a download, as hex strings. Empty checksums are not checked.
+type Checksums struct {
+	SHA1   string
+	MD5    string
+	SHA256 string
+}
+
+// ChecksumsFromFirmware returns the checksums known for a firmware by the api.
+func ChecksumsFromFirmware(fw *api.Firmware) Checksums {
+	return Checksums{
+		SHA1:   fw.SHA1Sum,
+		MD5:    fw.MD5Sum,
+		SHA256: fw.SHA256Sum,
+	}
+}
+
+// ChecksumsFromBuild returns the checksums known for a build in the iTunes version master.
+func ChecksumsFromBuild(build *IndividualBuild) Checksums {
+	return Checksums{
+		SHA1: build.FirmwareSHA1,
+	}
+}
+
+// ChecksumError is returned when a file does not match its expected checksum.
+type ChecksumError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("ipsw: %s mismatch, expected %s, got %s", e.Algorithm, e.Expected, e.Actual)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// VerifyFile checks the file at path against sums.
+func VerifyFile(path string, sums Checksums) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return sums.Verify(f)
+}
+
+// Verify reads r to EOF and checks it against the checksums.
+func (c Checksums) Verify(r io.Reader) error {
+	type check struct {
+		algorithm string
+		expected  string
+		hash      hash.Hash
+	}
+
+	var (
+		checks  []check
+		writers []io.Writer
+	)
+
+	for _, c := range []check{
+		{"sha1", c.SHA1, sha1.New()},
+		{"md5", c.MD5, md5.New()},
+		{"sha256", c.SHA256, sha256.New()},
+	} {
+		if c.expected == "" {
+			continue
+		}
+
+		checks = append(checks, c)
+		writers = append(writers, c.hash)
+	}
+
+	if len(checks) == 0 {
+		return nil
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return err
+	}
+
+	for _, c := range checks {
+		actual := hex.EncodeToString(c.hash.Sum(nil))
+
+		if !strings.EqualFold(actual, strings.TrimSpace(c.expected)) {
+			return &ChecksumError{Algorithm: c.algorithm, Expected: c.expected, Actual: actual}
+		}
+	}
+
+	return nil
+}
+
+// Progress is reported by a Downloader as a download proceeds.
+type Progress struct {
+	Downloaded int64
+	// Total is the size of the file, or -1 if it is not known.
+	Total int64
+}
+
+// Downloader fetches whole files, such as IPSWs, over several connections at once.
+// A download which is interrupted is resumed from where it got to next time it is started.
+// The zero value is ready to use.
+type Downloader struct {
+	// Connections is the number of range requests made at once. Defaults to 4.
+	Connections int
+
+	// ChunkSize is the number of bytes fetched by each range request. Defaults to RangeChunkSize.
+	ChunkSize int64
+
+	// Progress, if set, is called as data is downloaded. Calls are never concurrent.
+	Progress func(Progress)
+
+	// Checksums are checked once the download has finished.
+	Checksums Checksums
+
+	// Retry decides how failed range requests are retried. Defaults to DefaultRetryPolicy.
+	Retry *RetryPolicy
+
+	// Logger receives retries. Defaults to the log package.
+	Logger Logger
+
+	// Client makes the requests for the download, and provides Retry and Logger if they are not set.
+	// Defaults to the same client as the package level functions.
+	Client *Client
+}
+
+func (d *Downloader) client() *Client {
+	if d.Client == nil {
+		return defaultClient()
+	}
+
+	return d.Client
+}
+
+func (d *Downloader) options() *DownloadOptions {
+	return d.client().options(&DownloadOptions{Retry: d.Retry, Logger: d.Logger})
+}
+
+// downloadState is stored alongside a partial download so that it can be resumed.
+type downloadState struct {
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	ChunkSize    int64  `json:"chunk_size"`
+	Completed    []bool `json:"completed"`
+}
+
+func (s *downloadState) matches(other *downloadState) bool {
+	return s.URL == other.URL && s.Size == other.Size && s.ETag == other.ETag &&
+		s.LastModified == other.LastModified && s.ChunkSize == other.ChunkSize &&
+		len(s.Completed) == len(other.Completed)
+}
+
+func readDownloadState(path string) (*downloadState, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var state downloadState
+
+	err = json.Unmarshal(b, &state)
+
+	return &state, err
+}
+
+func (s *downloadState) write(path string) error {
+	b, err := json.Marshal(s)
+
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// download is a single run of a Downloader.
+type download struct {
+	*Downloader
+
+	url       string
+	file      *os.File
+	state     *downloadState
+	statePath string
+
+	mu         sync.Mutex
+	downloaded int64
+}
+
+func (d *download) progress(n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.downloaded += n
+
+	if d.Progress != nil {
+		d.Progress(Progress{Downloaded: d.downloaded, Total: d.state.Size})
+	}
+}
+
+// complete records chunk as done, once its data is on disk.
+func (d *download) complete(chunk int) error {
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state.Completed[chunk] = true
+
+	return d.state.write(d.statePath)
+}
+
+// progressWriter writes to the partial file at an offset, reporting progress as it goes.
+type progressWriter struct {
+	d       *download
+	offset  int64
+	written int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.d.file.WriteAt(p, w.offset+w.written)
+	w.written += int64(n)
+	w.d.progress(int64(n))
+
+	return n, err
+}
+
+func (d *download) fetchChunk(ctx context.Context, chunk int) error {
+	start := int64(chunk) * d.state.ChunkSize
+	end := start + d.state.ChunkSize
+
+	if end > d.state.Size {
+		end = d.state.Size
+	}
+
+	client := d.client()
+	opts := d.options()
+
+	err := opts.retry().Do(ctx, opts.logger(), func(attempt int) error {
+		body, err := client.fetchRange(ctx, d.url, start, end)
+
+		if err != nil {
+			return err
+		}
+
+		defer body.Close()
+
+		w := &progressWriter{d: d, offset: start}
+
+		_, err = io.CopyN(w, body, end-start)
+
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			// this chunk is fetched again from the start
+			d.progress(-w.written)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return d.complete(chunk)
+}
+
+// Download fetches url into dest. The download is written to dest+".part" until it is complete,
+// and the progress of the download is kept in dest+".part.json" so that it can be resumed.
+func (d *Downloader) Download(ctx context.Context, url, dest string) error {
+	state, err := d.probe(ctx, url)
+
+	if err != nil {
+		return err
+	}
+
+	partialPath := dest + partialDownloadSuffix
+	statePath := dest + downloadStateSuffix
+
+	if state.Size >= 0 {
+		err = d.downloadChunked(ctx, url, partialPath, statePath, state)
+
+		if httpStatus(err) == http.StatusOK {
+			// the server sent the whole file in answer to a range request
+			d.options().logger().Log("server ignored range request, downloading in one go", "url", url)
+
+			state.Size, state.Completed = -1, nil
+			err = d.downloadSingle(ctx, url, partialPath, statePath, state)
+		}
+	} else {
+		// without a known size the file can only be fetched in one go
+		err = d.downloadSingle(ctx, url, partialPath, statePath, state)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := VerifyFile(partialPath, d.Checksums); err != nil {
+		os.Remove(partialPath)
+		os.Remove(statePath)
+
+		return err
+	}
+
+	if err := os.Rename(partialPath, dest); err != nil {
+		return err
+	}
+
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// probe finds the size and validators of the file at url with a HEAD request, or with a GET of its
+// first byte if the server rejects HEAD requests.
+func (d *Downloader) probe(ctx context.Context, url string) (*downloadState, error) {
+	state, err := d.probeWith(ctx, url, http.MethodHead)
+
+	if err != nil && ctx.Err() == nil {
+		d.options().logger().Log("HEAD request failed, probing with GET", "url", url, "error", err)
+
+		state, err = d.probeWith(ctx, url, http.MethodGet)
+	}
+
+	return state, err
+}
+
+func (d *Downloader) probeWith(ctx context.Context, url, method string) (*downloadState, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+
+	res, err := d.client().do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res.Body.Close()
+
+	size := res.ContentLength
+
+	switch {
+	case method == http.MethodGet && res.StatusCode == http.StatusPartialContent:
+		size = contentRangeSize(res.Header.Get("Content-Range"))
+	case method == http.MethodGet && res.StatusCode == http.StatusOK:
+		// the whole file was sent, so it can't be fetched in ranges
+		size = -1
+	case res.StatusCode != http.StatusOK:
+		return nil, newHTTPStatusError(url, res)
+	}
+
+	chunkSize := d.ChunkSize
+
+	if chunkSize <= 0 {
+		chunkSize = RangeChunkSize
+	}
+
+	state := &downloadState{
+		URL:          url,
+		Size:         size,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		ChunkSize:    chunkSize,
+	}
+
+	if res.Header.Get("Accept-Ranges") == "none" {
+		state.Size = -1
+	}
+
+	if state.Size >= 0 {
+		state.Completed = make([]bool, (state.Size+chunkSize-1)/chunkSize)
+	}
+
+	return state, nil
+}
+
+func (d *Downloader) downloadChunked(ctx context.Context, url, partialPath, statePath string, state *downloadState) error {
+	if existing, err := readDownloadState(statePath); err == nil && existing.matches(state) {
+		if _, err := os.Stat(partialPath); err == nil {
+			state = existing
+		}
+	}
+
+	file, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if err := file.Truncate(state.Size); err != nil {
+		return err
+	}
+
+	dl := &download{
+		Downloader: d,
+		url:        url,
+		file:       file,
+		state:      state,
+		statePath:  statePath,
+	}
+
+	var remaining []int
+
+	for chunk, done := range state.Completed {
+		if done {
+			dl.downloaded += state.ChunkSize
+		} else {
+			remaining = append(remaining, chunk)
+		}
+	}
+
+	if n := len(state.Completed); n > 0 && state.Completed[n-1] {
+		// the last chunk is usually short
+		dl.downloaded -= int64(n)*state.ChunkSize - state.Size
+	}
+
+	if err := state.write(statePath); err != nil {
+		return err
+	}
+
+	dl.progress(0)
+
+	connections := d.Connections
+
+	if connections <= 0 {
+		connections = defaultDownloadConnections
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make(chan int)
+	errs := make(chan error, connections)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for chunk := range chunks {
+				if err := dl.fetchChunk(ctx, chunk); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, chunk := range remaining {
+		select {
+		case chunks <- chunk:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(chunks)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// downloadSingle fetches url without knowing its size. A partial file left by an earlier download of the
+// same file is resumed from its end, as is a failed request, if the server allows. Otherwise it is started again.
+func (d *Downloader) downloadSingle(ctx context.Context, url, partialPath, statePath string, state *downloadState) error {
+	var written int64
+
+	if existing, err := readDownloadState(statePath); err == nil && existing.matches(state) {
+		if info, err := os.Stat(partialPath); err == nil {
+			written = info.Size()
+		}
+	}
+
+	file, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if err := file.Truncate(written); err != nil {
+		return err
+	}
+
+	if err := state.write(statePath); err != nil {
+		return err
+	}
+
+	dl := &download{
+		Downloader: d,
+		url:        url,
+		file:       file,
+		state:      state,
+		downloaded: written,
+	}
+
+	dl.progress(0)
+
+	client := d.client()
+	opts := d.options()
+
+	err = opts.retry().Do(ctx, opts.logger(), func(attempt int) error {
+		body, offset, err := client.stream(ctx, url, written)
+
+		if httpStatus(err) == http.StatusRequestedRangeNotSatisfiable && written > 0 {
+			// the partial file is no shorter than the file, so it can't be part of it
+			body, offset, err = client.stream(ctx, url, 0)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		defer body.Close()
+
+		if offset != written {
+			// the range was ignored, so start again
+			if err := file.Truncate(0); err != nil {
+				return permanentError{err}
+			}
+
+			dl.progress(-written)
+			written = 0
+		}
+
+		n, err := io.Copy(&progressWriter{d: dl, offset: written}, body)
+		written += n
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// contentRangeSize returns the complete length given by a Content-Range header, or -1 if it is not known.
+func contentRangeSize(header string) int64 {
+	i := strings.LastIndexByte(header, '/')
+
+	if i < 0 {
+		return -1
+	}
+
+	size, err := strconv.ParseInt(header[i+1:], 10, 64)
+
+	if err != nil {
+		return -1
+	}
+
+	return size
+}
+
+// httpStatus returns the status code of the HTTPStatusError in err, or 0 if there is none.
+func httpStatus(err error) int {
+	var statusErr *HTTPStatusError
+
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+
+	return 0
+}
@@ -0,0 +1,241 @@
+package ipsw
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testDownloadServer serves content, with the features of the server being tested.
+type testDownloadServer struct {
+	content []byte
+
+	ranges bool // answer range requests with 206
+	head   bool // answer HEAD requests
+	sized  bool // send a Content-Length
+
+	mu        sync.Mutex
+	failAfter int // if set, drop the connection after this many bytes
+	requests  []string
+}
+
+func (s *testDownloadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, strings.TrimSpace(r.Method+" "+r.Header.Get("Range")))
+	failAfter := s.failAfter
+	s.mu.Unlock()
+
+	if r.Method == http.MethodHead && !s.head {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start, end, status := 0, len(s.content), http.StatusOK
+
+	if rng := r.Header.Get("Range"); rng != "" && s.ranges {
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err == nil {
+			end++
+		}
+
+		if start >= len(s.content) {
+			http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		if end > len(s.content) {
+			end = len(s.content)
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(s.content)))
+		status = http.StatusPartialContent
+	}
+
+	if s.sized {
+		w.Header().Set("Content-Length", fmt.Sprint(end-start))
+	}
+
+	w.WriteHeader(status)
+
+	if !s.sized {
+		// send the headers now, so that no Content-Length is added
+		w.(http.Flusher).Flush()
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if failAfter > 0 && start+failAfter < end {
+		w.Write(s.content[start : start+failAfter])
+		w.(http.Flusher).Flush()
+
+		panic(http.ErrAbortHandler)
+	}
+
+	w.Write(s.content[start:end])
+}
+
+func (s *testDownloadServer) setFailAfter(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failAfter = n
+}
+
+func (s *testDownloadServer) lastRequest() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[len(s.requests)-1]
+}
+
+func testDownload(t *testing.T, s *testDownloadServer, attempts int) (string, error) {
+	t.Helper()
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha1.Sum(s.content)
+
+	retry := quietRetry()
+	retry.MaxAttempts = attempts
+
+	d := &Downloader{
+		ChunkSize: 100,
+		Checksums: Checksums{SHA1: hex.EncodeToString(sum[:])},
+		Client:    &Client{Retry: retry, Logger: discardLogger},
+	}
+
+	dest := filepath.Join(dir, "firmware.ipsw")
+
+	return dest, d.Download(context.Background(), server.URL+"/firmware.ipsw", dest)
+}
+
+func testDownloadContent() []byte {
+	return bytes.Repeat([]byte("0123456789abcdef"), 64)
+}
+
+func assertDownloaded(t *testing.T, dest string, content []byte) {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(dest)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, content) {
+		t.Fatalf("downloaded %d bytes which do not match the %d served", len(b), len(content))
+	}
+}
+
+func TestDownloaderResumesUnsized(t *testing.T) {
+	s := &testDownloadServer{content: testDownloadContent(), ranges: true, head: true}
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "firmware.ipsw")
+	retry := quietRetry()
+	retry.MaxAttempts = 1
+
+	d := &Downloader{Client: &Client{Retry: retry, Logger: discardLogger}}
+
+	interrupt := func(url string) int64 {
+		s.setFailAfter(300)
+
+		if err := d.Download(context.Background(), url, dest); err == nil {
+			t.Fatal("expected the interrupted download to fail")
+		}
+
+		info, err := os.Stat(dest + partialDownloadSuffix)
+
+		if err != nil || info.Size() == 0 {
+			t.Fatalf("expected a partial download, got %v, %v", info, err)
+		}
+
+		s.setFailAfter(0)
+
+		return info.Size()
+	}
+
+	// a new run picks up the partial file where it stopped
+	written := interrupt(server.URL + "/firmware.ipsw")
+
+	if err := d.Download(context.Background(), server.URL+"/firmware.ipsw", dest); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := s.lastRequest(), fmt.Sprintf("GET bytes=%d-", written); got != want {
+		t.Fatalf("resumed download made request %q, expected %q", got, want)
+	}
+
+	assertDownloaded(t, dest, s.content)
+
+	// but not one left by a download of another file
+	interrupt(server.URL + "/firmware.ipsw")
+
+	if err := d.Download(context.Background(), server.URL+"/other.ipsw", dest); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.lastRequest(); got != "GET" {
+		t.Fatalf("download of another file made request %q", got)
+	}
+
+	assertDownloaded(t, dest, s.content)
+}
+
+func TestDownloaderRangeIgnored(t *testing.T) {
+	s := &testDownloadServer{content: testDownloadContent(), head: true, sized: true}
+
+	dest, err := testDownload(t, s, 3)
+	defer os.RemoveAll(filepath.Dir(dest))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertDownloaded(t, dest, s.content)
+}
+
+func TestDownloaderHeadRejected(t *testing.T) {
+	s := &testDownloadServer{content: testDownloadContent(), ranges: true, sized: true}
+
+	dest, err := testDownload(t, s, 3)
+	defer os.RemoveAll(filepath.Dir(dest))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertDownloaded(t, dest, s.content)
+
+	if s.requests[1] != "GET bytes=0-0" || len(s.requests) != 2+(len(s.content)+99)/100 {
+		t.Fatalf("expected a GET probe and a request for each chunk, got %v", s.requests)
+	}
+}
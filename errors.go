@@ -0,0 +1,292 @@
+package ipsw
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrFileNotFound is returned when a file is not in an archive. See FileNotFoundError.
+	ErrFileNotFound = errors.New("ipsw: file not found")
+
+	// ErrIdentifierNotFound is returned when a device identifier is not in a manifest. See IdentifierNotFoundError.
+	ErrIdentifierNotFound = errors.New("ipsw: identifier not found")
+
+	// ErrIdentityNotFound is returned when no build identity matches a query. See IdentityNotFoundError.
+	ErrIdentityNotFound = errors.New("ipsw: build identity not found")
+
+	// ErrAmbiguousIdentity is returned when build identities for more than one board match a query. See AmbiguousIdentityError.
+	ErrAmbiguousIdentity = errors.New("ipsw: build identity is ambiguous")
+
+	// ErrComponentNotFound is returned when a build identity has no such component. See ComponentNotFoundError.
+	ErrComponentNotFound = errors.New("ipsw: component not found")
+
+	// ErrElementNotFound is returned when an image has no element with a signature. See ElementNotFoundError.
+	ErrElementNotFound = errors.New("ipsw: element not found")
+
+	// ErrFirmwareNotFound is returned when the api has no URL for a firmware, which is usually because it is a beta.
+	ErrFirmwareNotFound = errors.New("ipsw: firmware not found (potentially beta)")
+
+	// ErrBadZip is returned when a zip could not be read after retrying. See ZipFormatError.
+	ErrBadZip = errors.New("ipsw: bad zip")
+
+	// ErrTSSRefused is returned when a TSS server refuses a personalisation request. See TSSError.
+	ErrTSSRefused = errors.New("ipsw: tss request refused")
+
+	// ErrNotSigned is returned when a TSS server refuses a request because the build is not being signed. See TSSError.
+	ErrNotSigned = errors.New("ipsw: build not signed")
+
+	// ErrNonceMismatch is returned when a blob's ApNonce is not derived from its generator. See NonceMismatchError.
+	ErrNonceMismatch = errors.New("ipsw: nonce does not match generator")
+
+	// ErrNotHTTPSource is returned when HTTP headers are asked of a source which has none. See NotHTTPSourceError.
+	ErrNotHTTPSource = errors.New("ipsw: not an http source")
+
+	// ErrHTTPStatus is returned when a server responds with an unexpected status. See HTTPStatusError.
+	ErrHTTPStatus = errors.New("ipsw: unexpected http status")
+
+	// ErrChecksumMismatch is returned when a file does not match its checksum. See ChecksumError.
+	ErrChecksumMismatch = errors.New("ipsw: checksum mismatch")
+
+	// ErrBadImage is returned when an image container could not be parsed. See ImageFormatError.
+	ErrBadImage = errors.New("ipsw: bad image")
+
+	// ErrBadKey is returned when a decrypted payload is not recognised, usually because the key is wrong. See DecryptionError.
+	ErrBadKey = errors.New("ipsw: bad key")
+)
+
+// FileNotFoundError is returned when a file is not in an archive.
+type FileNotFoundError struct {
+	Name     string
+	Resource string
+}
+
+func (e *FileNotFoundError) Error() string {
+	return fmt.Sprintf("pwn: file '%s' not found in resource '%s'", e.Name, e.Resource)
+}
+
+func (e *FileNotFoundError) Is(target error) bool {
+	return target == ErrFileNotFound
+}
+
+// NotHTTPSourceError is returned when HTTP headers are asked of a source which is neither
+// remote nor a local file, such as one made by NewReaderAtSource.
+type NotHTTPSourceError struct {
+	Resource string
+}
+
+func (e *NotHTTPSourceError) Error() string {
+	return fmt.Sprintf("ipsw: resource '%s' is not an http source", e.Resource)
+}
+
+func (e *NotHTTPSourceError) Is(target error) bool {
+	return target == ErrNotHTTPSource
+}
+
+// IdentifierNotFoundError is returned when a device identifier is not found, In a manifest or list.
+type IdentifierNotFoundError struct {
+	Identifier Identifier
+	In         string
+}
+
+func (e *IdentifierNotFoundError) Error() string {
+	return fmt.Sprintf("ipsw: unable to find identifier: %s in %s", e.Identifier, e.In)
+}
+
+func (e *IdentifierNotFoundError) Is(target error) bool {
+	return target == ErrIdentifierNotFound
+}
+
+// IdentityNotFoundError is returned when no build identity of a manifest matches Query.
+type IdentityNotFoundError struct {
+	Query IdentityQuery
+}
+
+func (e *IdentityNotFoundError) Error() string {
+	q := e.Query
+	board := q.BoardConfig
+
+	if q.Device != nil {
+		board = fmt.Sprintf("%s (CPID %#x, BDID %#x)", q.Device.BoardConfig, q.Device.CPID, q.Device.BDID)
+	}
+
+	return fmt.Sprintf("ipsw: no build identity for identifier '%s', board '%s', restore behavior '%s', variant '%s'",
+		q.Identifier, board, q.RestoreBehavior, q.Variant)
+}
+
+func (e *IdentityNotFoundError) Is(target error) bool {
+	return target == ErrIdentityNotFound
+}
+
+// AmbiguousIdentityError is returned when build identities for more than one board match Query,
+// so the board must be given with a Device or BoardConfig.
+type AmbiguousIdentityError struct {
+	Query IdentityQuery
+	// Boards are the board configs of the matching identities, or their ApBoardID if they have none.
+	Boards []string
+}
+
+func (e *AmbiguousIdentityError) Error() string {
+	return fmt.Sprintf("ipsw: build identities for identifier '%s' span boards %s, a device or board config is needed",
+		e.Query.Identifier, strings.Join(e.Boards, ", "))
+}
+
+func (e *AmbiguousIdentityError) Is(target error) bool {
+	return target == ErrAmbiguousIdentity
+}
+
+// ComponentNotFoundError is returned when a build identity has no such component, e.g. BasebandFirmware.
+type ComponentNotFoundError struct {
+	Component  string
+	Identifier Identifier
+}
+
+func (e *ComponentNotFoundError) Error() string {
+	if e.Identifier == "" {
+		return fmt.Sprintf("ipsw: component %s not found", e.Component)
+	}
+
+	return fmt.Sprintf("ipsw: component %s not found for %s", e.Component, e.Identifier)
+}
+
+func (e *ComponentNotFoundError) Is(target error) bool {
+	return target == ErrComponentNotFound
+}
+
+// ElementNotFoundError is returned when an image has no element with Signature.
+type ElementNotFoundError struct {
+	Signature ElementType
+}
+
+func (e *ElementNotFoundError) Error() string {
+	return fmt.Sprintf("element with signature: %d not found", e.Signature)
+}
+
+func (e *ElementNotFoundError) Is(target error) bool {
+	return target == ErrElementNotFound
+}
+
+// ZipFormatError is returned when the zip in Resource could not be read after Attempts tries.
+// It unwraps to the last error seen, usually zip.ErrFormat.
+type ZipFormatError struct {
+	Resource string
+	Attempts int
+	Err      error
+}
+
+func (e *ZipFormatError) Error() string {
+	return fmt.Sprintf("ipsw: unable to read zip '%s' after %d attempts: %s", e.Resource, e.Attempts, e.Err)
+}
+
+func (e *ZipFormatError) Is(target error) bool {
+	return target == ErrBadZip
+}
+
+func (e *ZipFormatError) Unwrap() error {
+	return e.Err
+}
+
+// ImageFormatError is returned when an image container, such as an IM4P, could not be parsed.
+type ImageFormatError struct {
+	Format string
+	Err    error
+}
+
+func (e *ImageFormatError) Error() string {
+	return fmt.Sprintf("ipsw: invalid %s: %s", e.Format, e.Err)
+}
+
+func (e *ImageFormatError) Is(target error) bool {
+	return target == ErrBadImage
+}
+
+func (e *ImageFormatError) Unwrap() error {
+	return e.Err
+}
+
+// DecryptionError is returned when a payload does not start with a known magic once it has been decrypted.
+type DecryptionError struct {
+	Format string
+	// Type is the four character type of the image, e.g. "krnl".
+	Type  string
+	Magic []byte
+}
+
+func (e *DecryptionError) Error() string {
+	return fmt.Sprintf("ipsw: decrypted %s %s has unknown magic %x, the key is probably wrong", e.Type, e.Format, e.Magic)
+}
+
+func (e *DecryptionError) Is(target error) bool {
+	return target == ErrBadKey
+}
+
+// TSSError is returned when a TSS server refuses a request with a non-zero Status.
+type TSSError struct {
+	Status  int
+	Message string
+}
+
+func (e *TSSError) Error() string {
+	return fmt.Sprintf("ipsw: tss refused request with status %d: %s", e.Status, e.Message)
+}
+
+func (e *TSSError) Is(target error) bool {
+	return target == ErrTSSRefused || (target == ErrNotSigned && e.Status == TSSStatusNotSigned)
+}
+
+// NonceMismatchError is returned when the ApNonce of a blob is not the one Expected from its Generator,
+// so the blob could not be used to restore.
+type NonceMismatchError struct {
+	Generator string
+	Expected  []byte
+	ApNonce   []byte
+}
+
+func (e *NonceMismatchError) Error() string {
+	return fmt.Sprintf("ipsw: blob has nonce %x, but generator %s gives %x", e.ApNonce, e.Generator, e.Expected)
+}
+
+func (e *NonceMismatchError) Is(target error) bool {
+	return target == ErrNonceMismatch
+}
+
+// HTTPStatusError is returned when a request to URL gets an unexpected response.
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+
+	// RetryAfter is the wait asked for by the server's Retry-After header, if any.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("ipsw: unexpected status for '%s': %s", e.URL, e.Status)
+}
+
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrHTTPStatus
+}
+
+func newHTTPStatusError(url string, res *http.Response) *HTTPStatusError {
+	return &HTTPStatusError{
+		URL:        url,
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+}
+
+// checkResponse returns an HTTPStatusError, closing the body, if res is not a 2xx response.
+func checkResponse(url string, res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	res.Body.Close()
+
+	return newHTTPStatusError(url, res)
+}
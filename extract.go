@@ -0,0 +1,364 @@
+package ipsw
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MaxExtractConnections is the number of byte ranges fetched at once by Extract.
+var MaxExtractConnections = 4
+
+// MaxExtractMergeGap is the largest gap, in bytes, between two files for which
+// Extract will still fetch both files with a single range request.
+var MaxExtractMergeGap int64 = 64 * 1024
+
+// WriterFunc returns the destination for a file being extracted. The returned writer is
+// closed once the file has been written. WriterFunc may be called from multiple goroutines.
+type WriterFunc func(f ZipFile) (io.WriteCloser, error)
+
+// extractEntry is a file to be extracted, and where it is.
+type extractEntry struct {
+	file *zip.File
+
+	// offset is where the file's local header starts or, if header is false, where its compressed data starts.
+	offset int64
+	header bool
+}
+
+// end is where the file's compressed data ends. The size of a local header is taken to be the size
+// of the file's header in the central directory, which it usually is, until it has been read.
+func (e extractEntry) end() int64 {
+	end := e.offset + int64(e.file.CompressedSize64)
+
+	if e.header {
+		end += zipLocalHeaderLen + int64(len(e.file.Name)+len(e.file.Extra))
+	}
+
+	return end
+}
+
+// extractRange is a run of files which are fetched with one range request.
+type extractRange struct {
+	start, end int64
+	entries    []extractEntry
+}
+
+// match returns every file in the zip which matches at least one of patterns.
+// Patterns use the syntax of path.Match and are matched against the full name of each file.
+func (z *zipArchive) match(patterns []string) ([]*zip.File, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("ipsw: invalid pattern '%s': %w", pattern, err)
+		}
+	}
+
+	var matches []*zip.File
+
+	for _, f := range z.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, f.Name); ok {
+				matches = append(matches, f)
+				break
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+// mergeRanges groups entries, sorted by offset, into as few range requests as possible.
+func mergeRanges(entries []extractEntry) []*extractRange {
+	var ranges []*extractRange
+
+	for _, entry := range entries {
+		if n := len(ranges); n > 0 && entry.offset-ranges[n-1].end <= MaxExtractMergeGap {
+			last := ranges[n-1]
+			last.entries = append(last.entries, entry)
+
+			if entry.end() > last.end {
+				last.end = entry.end()
+			}
+
+			continue
+		}
+
+		ranges = append(ranges, &extractRange{
+			start:   entry.offset,
+			end:     entry.end(),
+			entries: []extractEntry{entry},
+		})
+	}
+
+	return ranges
+}
+
+func (z *zipArchive) extractMatching(ctx context.Context, patterns []string, fn WriterFunc) ([]ZipFile, error) {
+	files, err := z.match(patterns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := z.entries(ctx, files)
+
+	if err != nil {
+		return nil, err
+	}
+
+	extracted := make([]ZipFile, 0, len(files))
+
+	for _, f := range files {
+		extracted = append(extracted, newZipFile(f))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].offset < entries[j].offset
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	connections := MaxExtractConnections
+
+	if connections < 1 {
+		connections = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		sem      = make(chan struct{}, connections)
+	)
+
+	for _, r := range mergeRanges(entries) {
+		sem <- struct{}{}
+
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+
+		go func(r *extractRange) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := z.extractRange(ctx, r, fn); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(r)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return extracted, ctx.Err()
+}
+
+// entries finds each of files in the zip. Their local headers are fetched along with their data, if their
+// offsets can be read from the central directory. Otherwise each local header is read on its own.
+func (z *zipArchive) entries(ctx context.Context, files []*zip.File) ([]extractEntry, error) {
+	entries := make([]extractEntry, 0, len(files))
+
+	offsets, err := z.headerOffsets(ctx)
+
+	if err == nil {
+		index := make(map[*zip.File]int64, len(z.File))
+
+		for i, f := range z.File {
+			index[f] = offsets[i]
+		}
+
+		for _, f := range files {
+			entries = append(entries, extractEntry{file: f, offset: index[f], header: true})
+		}
+
+		return entries, nil
+	}
+
+	if ctx.Err() != nil {
+		return nil, err
+	}
+
+	z.opts.logger().Log("unable to read local header offsets, reading each local header", "resource", sourceName(z.src), "error", err)
+
+	for _, f := range files {
+		offset, err := z.dataOffset(ctx, f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, extractEntry{file: f, offset: offset})
+	}
+
+	return entries, nil
+}
+
+// extractRange fetches r in order, in requests of at most RangeChunkSize, and writes out each of its files in turn.
+func (z *zipArchive) extractRange(ctx context.Context, r *extractRange, fn WriterFunc) error {
+	body := newRangeReader(ctx, z.src, r.start, r.end-r.start, z.opts)
+	defer body.Close()
+
+	position := r.start
+
+	for _, entry := range r.entries {
+		if entry.offset < position {
+			// overlapping entries never happen in a well formed zip
+			return zip.ErrFormat
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, body, entry.offset-position); err != nil {
+			return err
+		}
+
+		position = entry.offset
+
+		if entry.header {
+			rest, err := readLocalHeader(body, entry.file)
+
+			if err != nil {
+				return err
+			}
+
+			position += zipLocalHeaderLen
+
+			if end := position + rest + int64(entry.file.CompressedSize64); end > body.end {
+				// the local header is larger than the one in the central directory, so the range is extended to fit
+				body.end = end
+			}
+
+			if _, err := io.CopyN(ioutil.Discard, body, rest); err != nil {
+				return err
+			}
+
+			position += rest
+		}
+
+		if err := extractEntryTo(entry.file, io.LimitReader(body, int64(entry.file.CompressedSize64)), fn); err != nil {
+			return err
+		}
+
+		position += int64(entry.file.CompressedSize64)
+	}
+
+	return nil
+}
+
+func extractEntryTo(f *zip.File, compressed io.Reader, fn WriterFunc) error {
+	rc, err := decompressor(f, compressed)
+
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+
+	w, err := fn(newZipFile(f))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, rc)
+
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// directoryWriter returns a WriterFunc which creates each file beneath dir.
+func directoryWriter(dir string) WriterFunc {
+	return func(f ZipFile) (io.WriteCloser, error) {
+		name := filepath.FromSlash(path.Clean("/" + f.Name))
+		target := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+
+		return os.Create(target)
+	}
+}
+
+// Extract extracts every file in the IPSW matching at least one of patterns (see path.Match),
+// e.g. "Firmware/all_flash/*.im4p" or "kernelcache.*". The data for matching files is fetched
+// with up to MaxExtractConnections range requests at once, with neighbouring files merged into
+// a single request. The files extracted are returned.
+func (i *IPSW) Extract(patterns []string, fn WriterFunc) ([]ZipFile, error) {
+	return i.ExtractContext(context.Background(), patterns, fn)
+}
+
+func (i *IPSW) ExtractContext(ctx context.Context, patterns []string, fn WriterFunc) ([]ZipFile, error) {
+	z, err := i.zip(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return z.extractMatching(ctx, patterns, fn)
+}
+
+// ExtractToDirectory extracts every file in the IPSW matching patterns into dir,
+// keeping the directory structure of the IPSW.
+func (i *IPSW) ExtractToDirectory(dir string, patterns ...string) ([]ZipFile, error) {
+	return i.ExtractToDirectoryContext(context.Background(), dir, patterns...)
+}
+
+func (i *IPSW) ExtractToDirectoryContext(ctx context.Context, dir string, patterns ...string) ([]ZipFile, error) {
+	return i.ExtractContext(ctx, patterns, directoryWriter(dir))
+}
+
+// ExtractFiles extracts every file in the zip at resource matching patterns. See IPSW.Extract.
+func ExtractFiles(resource string, patterns []string, fn WriterFunc) ([]ZipFile, error) {
+	return defaultClient().ExtractFiles(resource, patterns, fn)
+}
+
+func ExtractFilesContext(ctx context.Context, resource string, patterns []string, fn WriterFunc) ([]ZipFile, error) {
+	return defaultClient().ExtractFilesContext(ctx, resource, patterns, fn)
+}
+
+func (c *Client) ExtractFiles(resource string, patterns []string, fn WriterFunc) ([]ZipFile, error) {
+	return c.ExtractFilesContext(context.Background(), resource, patterns, fn)
+}
+
+func (c *Client) ExtractFilesContext(ctx context.Context, resource string, patterns []string, fn WriterFunc) ([]ZipFile, error) {
+	src, err := c.NewSource(resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeSource(src)
+
+	z, err := openZip(ctx, src, c.options(nil))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return z.extractMatching(ctx, patterns, fn)
+}
@@ -0,0 +1,196 @@
+package ipsw
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"testing"
+)
+
+type testZipFile struct {
+	name, content string
+}
+
+// testStoredZip builds a zip of stored files by hand. Each local header has an extra field of
+// localExtra bytes which is not in the central directory, and the offset of the last file is
+// given in a zip64 extra field.
+func testStoredZip(files []testZipFile, localExtra int) []byte {
+	buf := new(bytes.Buffer)
+	directory := new(bytes.Buffer)
+
+	le := func(w io.Writer, v ...interface{}) {
+		for _, v := range v {
+			binary.Write(w, binary.LittleEndian, v)
+		}
+	}
+
+	for i, f := range files {
+		offset := buf.Len()
+		crc, size := crc32.ChecksumIEEE([]byte(f.content)), uint32(len(f.content))
+
+		le(buf, uint32(zipLocalHeaderSignature), uint16(20), uint16(0), uint16(zip.Store), uint32(0), crc, size, size,
+			uint16(len(f.name)), uint16(localExtra))
+		buf.WriteString(f.name)
+		le(buf, uint16(0xcafe), uint16(localExtra-4))
+		buf.Write(make([]byte, localExtra-4))
+		buf.WriteString(f.content)
+
+		headerOffset, extra := uint32(offset), []byte(nil)
+
+		if i == len(files)-1 {
+			zip64 := new(bytes.Buffer)
+			le(zip64, uint16(zip64ExtraID), uint16(8), uint64(offset))
+
+			headerOffset, extra = 0xffffffff, zip64.Bytes()
+		}
+
+		le(directory, uint32(zipDirectoryHeaderSignature), uint16(45), uint16(45), uint16(0), uint16(zip.Store), uint32(0),
+			crc, size, size, uint16(len(f.name)), uint16(len(extra)), uint16(0), uint16(0), uint16(0), uint32(0), headerOffset)
+		directory.WriteString(f.name)
+		directory.Write(extra)
+	}
+
+	directoryOffset := buf.Len()
+	directory.WriteTo(buf)
+
+	le(buf, uint32(zipDirectoryEndSignature), uint16(0), uint16(0), uint16(len(files)), uint16(len(files)),
+		uint32(buf.Len()-directoryOffset), uint32(directoryOffset), uint16(0))
+
+	return buf.Bytes()
+}
+
+// countingSource counts the reads made of a Source.
+type countingSource struct {
+	Source
+
+	mu      sync.Mutex
+	readAts int
+	ranges  int
+}
+
+func (c *countingSource) ReadAt(ctx context.Context, p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	c.readAts++
+	c.mu.Unlock()
+
+	return c.Source.ReadAt(ctx, p, off)
+}
+
+func (c *countingSource) Range(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+	c.mu.Lock()
+	c.ranges++
+	c.mu.Unlock()
+
+	return c.Source.Range(ctx, off, length)
+}
+
+func (c *countingSource) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.readAts, c.ranges
+}
+
+func testExtract(t *testing.T, src Source, patterns ...string) map[string]string {
+	t.Helper()
+
+	var mu sync.Mutex
+
+	contents := make(map[string]string)
+
+	_, err := NewIPSWWithSource("iPhone12,1", "17A577", src).Extract(patterns, func(f ZipFile) (io.WriteCloser, error) {
+		return &testExtractWriter{name: f.Name, mu: &mu, contents: contents}, nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return contents
+}
+
+type testExtractWriter struct {
+	bytes.Buffer
+
+	name     string
+	mu       *sync.Mutex
+	contents map[string]string
+}
+
+func (w *testExtractWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.contents[w.name] = w.String()
+
+	return nil
+}
+
+func TestExtractLocalHeaders(t *testing.T) {
+	files := []testZipFile{
+		{"BuildManifest.plist", "manifest"},
+		{"Firmware/all_flash/iBoot.im4p", "iboot"},
+		{"Firmware/all_flash/LLB.im4p", "llb"},
+	}
+
+	data := testStoredZip(files, 16)
+
+	// each file on its own, and all of them in one range
+	for _, patterns := range [][]string{{"BuildManifest.plist"}, {"Firmware/all_flash/LLB.im4p"}, {"*", "*/*/*"}} {
+		contents := testExtract(t, NewReaderAtSource(bytes.NewReader(data), int64(len(data))), patterns...)
+
+		for _, f := range files {
+			if _, ok := contents[f.name]; ok && contents[f.name] != f.content {
+				t.Errorf("extracted %q for %s, expected %q", contents[f.name], f.name, f.content)
+			}
+		}
+
+		if len(patterns) > 1 && len(contents) != len(files) {
+			t.Errorf("extracted %d files, expected %d", len(contents), len(files))
+		}
+	}
+}
+
+func TestExtractRequests(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+
+	for i := 0; i < 20; i++ {
+		f, err := w.Create(fmt.Sprintf("Firmware/all_flash/%02d.im4p", i))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fmt.Fprintf(f, "image %d", i)
+	}
+
+	w.Close()
+
+	counts := func(patterns ...string) (int, int) {
+		src := &countingSource{Source: NewReaderAtSource(bytes.NewReader(buf.Bytes()), int64(buf.Len()))}
+		contents := testExtract(t, src, patterns...)
+
+		if contents["Firmware/all_flash/07.im4p"] != "image 7" {
+			t.Fatalf("extracted %q", contents["Firmware/all_flash/07.im4p"])
+		}
+
+		return src.counts()
+	}
+
+	oneReads, oneRanges := counts("Firmware/all_flash/07.im4p")
+	allReads, allRanges := counts("Firmware/all_flash/*.im4p")
+
+	if allReads != oneReads {
+		t.Errorf("extracting 20 files made %d reads, and extracting one made %d", allReads, oneReads)
+	}
+
+	if oneRanges != 1 || allRanges != 1 {
+		t.Errorf("expected one range request for neighbouring files, got %d and %d", oneRanges, allRanges)
+	}
+}
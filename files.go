@@ -0,0 +1,99 @@
+package ipsw
+
+import (
+	"archive/zip"
+	"context"
+	"strings"
+	"time"
+)
+
+// ZipFile describes a file in a firmware archive, as read from its central directory.
+type ZipFile struct {
+	Name             string
+	CompressedSize   uint64
+	UncompressedSize uint64
+	CRC32            uint32
+	Modified         time.Time
+	// Method is the compression method, e.g. zip.Store or zip.Deflate
+	Method uint16
+}
+
+// IsDir reports whether the entry is a directory.
+func (f ZipFile) IsDir() bool {
+	return strings.HasSuffix(f.Name, "/")
+}
+
+func newZipFile(f *zip.File) ZipFile {
+	modified := f.Modified
+
+	if modified.IsZero() {
+		modified = f.ModTime()
+	}
+
+	return ZipFile{
+		Name:             f.Name,
+		CompressedSize:   f.CompressedSize64,
+		UncompressedSize: f.UncompressedSize64,
+		CRC32:            f.CRC32,
+		Modified:         modified,
+		Method:           f.Method,
+	}
+}
+
+func (z *zipArchive) files() []ZipFile {
+	files := make([]ZipFile, 0, len(z.File))
+
+	for _, f := range z.File {
+		files = append(files, newZipFile(f))
+	}
+
+	return files
+}
+
+// ListFiles lists every file in the zip at resource, a URL or local path.
+// Only the central directory is downloaded.
+func ListFiles(resource string) ([]ZipFile, error) {
+	return defaultClient().ListFiles(resource)
+}
+
+func ListFilesContext(ctx context.Context, resource string) ([]ZipFile, error) {
+	return defaultClient().ListFilesContext(ctx, resource)
+}
+
+func (c *Client) ListFiles(resource string) ([]ZipFile, error) {
+	return c.ListFilesContext(context.Background(), resource)
+}
+
+func (c *Client) ListFilesContext(ctx context.Context, resource string) ([]ZipFile, error) {
+	src, err := c.NewSource(resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeSource(src)
+
+	z, err := openZip(ctx, src, c.options(nil))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return z.files(), nil
+}
+
+// Files lists every file in the IPSW. Only the central directory is downloaded,
+// and it is shared with later extractions from the IPSW.
+func (i *IPSW) Files() ([]ZipFile, error) {
+	return i.FilesContext(context.Background())
+}
+
+func (i *IPSW) FilesContext(ctx context.Context) ([]ZipFile, error) {
+	z, err := i.zip(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return z.files(), nil
+}
@@ -0,0 +1,240 @@
+package ipsw
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// IdentityQuery selects build identities from a BuildManifest. Fields left empty match any identity.
+type IdentityQuery struct {
+	// Identifier is the product type, e.g. iPhone12,1. On its own it only selects an identity for manifests
+	// with one identity per product type; set Device or BoardConfig to select by board.
+	Identifier Identifier
+
+	// Device matches the ApChipID and ApBoardID of an identity, and its Info.DeviceClass if Device.BoardConfig is set.
+	Device *Device
+
+	// BoardConfig matches Info.DeviceClass, e.g. n104ap.
+	BoardConfig string
+
+	// RestoreBehavior matches Info.RestoreBehavior, e.g. Erase or Update.
+	RestoreBehavior string
+
+	// Variant matches Info.Variant, e.g. "Customer Erase Install (IPSW)".
+	Variant string
+}
+
+func (q IdentityQuery) matches(identity *BuildIdentity) bool {
+	if q.Device != nil {
+		chipID, err := strconv.ParseUint(identity.ApChipID, 0, 64)
+
+		if err != nil || chipID != uint64(q.Device.CPID) {
+			return false
+		}
+
+		boardID, err := strconv.ParseUint(identity.ApBoardID, 0, 64)
+
+		if err != nil || boardID != uint64(q.Device.BDID) {
+			return false
+		}
+
+		if q.Device.BoardConfig != "" && !strings.EqualFold(q.Device.BoardConfig, identity.Info.DeviceClass) {
+			return false
+		}
+	}
+
+	if q.BoardConfig != "" && !strings.EqualFold(q.BoardConfig, identity.Info.DeviceClass) {
+		return false
+	}
+
+	if q.RestoreBehavior != "" && !strings.EqualFold(q.RestoreBehavior, identity.Info.RestoreBehavior) {
+		return false
+	}
+
+	if q.Variant != "" && !strings.EqualFold(q.Variant, identity.Info.Variant) {
+		return false
+	}
+
+	return true
+}
+
+// IsResearch reports whether the identity is a research variant, for security research devices.
+func (b *BuildIdentity) IsResearch() bool {
+	return strings.Contains(strings.ToLower(b.Info.Variant), "research")
+}
+
+// Component returns the component of the identity with name, e.g. KernelCache.
+func (b *BuildIdentity) Component(name string) (*Manifest, error) {
+	component, ok := b.Manifest[name]
+
+	if !ok {
+		return nil, &ComponentNotFoundError{Component: name}
+	}
+
+	return &component, nil
+}
+
+// Identities returns every build identity matching q, in the order of the manifest.
+func (m *BuildManifest) Identities(q IdentityQuery) []*BuildIdentity {
+	candidates := m.BuildIdentities
+
+	if q.Identifier != "" {
+		index := -1
+
+		for i, productType := range m.SupportedProductTypes {
+			if Identifier(productType) == q.Identifier {
+				index = i
+				break
+			}
+		}
+
+		if index == -1 {
+			return nil
+		}
+
+		// older manifests have a single identity for each product type, in the same order.
+		if q.Device == nil && q.BoardConfig == "" && len(m.SupportedProductTypes) == len(m.BuildIdentities) {
+			candidates = m.BuildIdentities[index : index+1]
+		}
+	}
+
+	var identities []*BuildIdentity
+
+	for i := range candidates {
+		if q.matches(&candidates[i]) {
+			identities = append(identities, &candidates[i])
+		}
+	}
+
+	return identities
+}
+
+// Identity returns the first build identity matching q. Research identities are only returned
+// if no other identity matches, or if q asks for their Variant. If identities for more than one
+// board match, e.g. because q has only an Identifier which is shared by several boards, an
+// AmbiguousIdentityError is returned.
+func (m *BuildManifest) Identity(q IdentityQuery) (*BuildIdentity, error) {
+	if q.Identifier != "" {
+		found := false
+
+		for _, productType := range m.SupportedProductTypes {
+			if Identifier(productType) == q.Identifier {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, &IdentifierNotFoundError{Identifier: q.Identifier, In: BuildManifestFilename}
+		}
+	}
+
+	identities := m.Identities(q)
+
+	if len(identities) == 0 {
+		return nil, &IdentityNotFoundError{Query: q}
+	}
+
+	if boards := identityBoards(identities); len(boards) > 1 {
+		return nil, &AmbiguousIdentityError{Query: q, Boards: boards}
+	}
+
+	for _, identity := range identities {
+		if !identity.IsResearch() {
+			return identity, nil
+		}
+	}
+
+	return identities[0], nil
+}
+
+// identityBoards returns the distinct boards of identities, by their board config or ApChipID and ApBoardID.
+func identityBoards(identities []*BuildIdentity) []string {
+	var (
+		boards []string
+		seen   = make(map[string]bool)
+	)
+
+	for _, identity := range identities {
+		key := strings.ToLower(identity.ApChipID + "/" + identity.ApBoardID)
+
+		chipID, chipErr := strconv.ParseUint(identity.ApChipID, 0, 64)
+		boardID, boardErr := strconv.ParseUint(identity.ApBoardID, 0, 64)
+
+		if chipErr == nil && boardErr == nil {
+			key = strconv.FormatUint(chipID, 16) + "/" + strconv.FormatUint(boardID, 16)
+		}
+
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+
+		board := identity.Info.DeviceClass
+
+		if board == "" {
+			board = identity.ApBoardID
+		}
+
+		boards = append(boards, board)
+	}
+
+	return boards
+}
+
+// BuildIdentity returns the build identity of the IPSW's device matching q. If q has no Identifier, the IPSW's
+// Identifier is used, and if it has no Device or BoardConfig, the device is looked up in the Restore.plist.
+// If the Restore.plist has no such device and the Identifier is shared by several boards, an
+// AmbiguousIdentityError is returned.
+func (i *IPSW) BuildIdentity(q IdentityQuery) (*BuildIdentity, error) {
+	return i.BuildIdentityContext(context.Background(), q)
+}
+
+func (i *IPSW) BuildIdentityContext(ctx context.Context, q IdentityQuery) (*BuildIdentity, error) {
+	manifest, err := i.BuildManifestContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Identifier == "" {
+		q.Identifier = Identifier(i.Identifier)
+	}
+
+	if q.Device == nil && q.BoardConfig == "" {
+		restore, err := i.RestorePlistContext(ctx)
+
+		if err == nil {
+			// not every product type is in the DeviceMap, so fall back to the manifest alone.
+			q.Device, _ = restore.DeviceByIdentifier(q.Identifier)
+		} else if !errors.Is(err, ErrFileNotFound) {
+			return nil, err
+		}
+	}
+
+	return manifest.Identity(q)
+}
+
+// Component returns the component with name, e.g. KernelCache, of the IPSW's device.
+func (i *IPSW) Component(name string) (*Manifest, error) {
+	return i.ComponentContext(context.Background(), name)
+}
+
+func (i *IPSW) ComponentContext(ctx context.Context, name string) (*Manifest, error) {
+	identity, err := i.BuildIdentityContext(ctx, IdentityQuery{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	component, ok := identity.Manifest[name]
+
+	if !ok {
+		return nil, &ComponentNotFoundError{Component: name, Identifier: Identifier(i.Identifier)}
+	}
+
+	return &component, nil
+}
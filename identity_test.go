@@ -0,0 +1,206 @@
+package ipsw
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"testing"
+
+	"howett.net/plist"
+)
+
+func testIdentity(chipID, boardID, boardConfig, restoreBehavior, variant string) BuildIdentity {
+	identity := BuildIdentity{ApChipID: chipID, ApBoardID: boardID}
+	identity.Info.DeviceClass = boardConfig
+	identity.Info.RestoreBehavior = restoreBehavior
+	identity.Info.Variant = variant
+
+	return identity
+}
+
+func testManifest() *BuildManifest {
+	return &BuildManifest{
+		SupportedProductTypes: []string{"iPhone12,1", "iPhone12,3"},
+		BuildIdentities: []BuildIdentity{
+			testIdentity("0x8030", "0x04", "n104ap", "Erase", "Research Customer Erase Install (IPSW)"),
+			testIdentity("0x8030", "0x04", "n104ap", "Erase", "Customer Erase Install (IPSW)"),
+			testIdentity("0x8030", "0x04", "n104ap", "Update", "Customer Upgrade Install (IPSW)"),
+			testIdentity("0x8030", "0x06", "d421ap", "Erase", "Customer Erase Install (IPSW)"),
+		},
+	}
+}
+
+func TestManifestIdentity(t *testing.T) {
+	m := testManifest()
+
+	identity, err := m.Identity(IdentityQuery{Identifier: "iPhone12,1", Device: &Device{CPID: 0x8030, BDID: 4}})
+
+	if err != nil || identity != &m.BuildIdentities[1] {
+		t.Fatalf("device query returned %v, %v", identity, err)
+	}
+
+	identity, err = m.Identity(IdentityQuery{BoardConfig: "N104AP", RestoreBehavior: "update"})
+
+	if err != nil || identity != &m.BuildIdentities[2] {
+		t.Fatalf("board config query returned %v, %v", identity, err)
+	}
+
+	identity, err = m.Identity(IdentityQuery{BoardConfig: "n104ap", Variant: "Research Customer Erase Install (IPSW)"})
+
+	if err != nil || identity != &m.BuildIdentities[0] {
+		t.Fatalf("research query returned %v, %v", identity, err)
+	}
+
+	if n := len(m.Identities(IdentityQuery{Device: &Device{CPID: 0x8030, BDID: 4}})); n != 3 {
+		t.Fatalf("expected 3 identities for the device, got %d", n)
+	}
+
+	if _, err := m.Identity(IdentityQuery{BoardConfig: "j71ap"}); !errors.Is(err, ErrIdentityNotFound) {
+		t.Fatalf("expected ErrIdentityNotFound, got %v", err)
+	}
+
+	if _, err := m.Identity(IdentityQuery{Identifier: "iPad1,1"}); !errors.Is(err, ErrIdentifierNotFound) {
+		t.Fatalf("expected ErrIdentifierNotFound, got %v", err)
+	}
+}
+
+func TestManifestIdentityAmbiguous(t *testing.T) {
+	m := testManifest()
+
+	_, err := m.Identity(IdentityQuery{Identifier: "iPhone12,1"})
+
+	var ambiguous *AmbiguousIdentityError
+
+	if !errors.Is(err, ErrAmbiguousIdentity) || !errors.As(err, &ambiguous) {
+		t.Fatalf("expected an AmbiguousIdentityError, got %v", err)
+	}
+
+	if len(ambiguous.Boards) != 2 || ambiguous.Boards[0] != "n104ap" || ambiguous.Boards[1] != "d421ap" {
+		t.Fatalf("unexpected boards %v", ambiguous.Boards)
+	}
+
+	// older manifests have one identity for each product type, in the same order
+	m.BuildIdentities = m.BuildIdentities[1:3]
+	m.BuildIdentities[1] = testIdentity("0x8030", "0x06", "d421ap", "Erase", "Customer Erase Install (IPSW)")
+
+	identity, err := m.Identity(IdentityQuery{Identifier: "iPhone12,3"})
+
+	if err != nil || identity != &m.BuildIdentities[1] {
+		t.Fatalf("legacy query returned %v, %v", identity, err)
+	}
+}
+
+func TestIPSWBuildIdentityWithoutRestorePlist(t *testing.T) {
+	manifest, err := plist.Marshal(testManifest(), plist.XMLFormat)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+
+	f, err := w.Create(BuildManifestFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write(manifest)
+	w.Close()
+
+	i := NewIPSWWithSource("iPhone12,1", "17A577", NewReaderAtSource(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+
+	if _, err := i.BuildIdentity(IdentityQuery{}); !errors.Is(err, ErrAmbiguousIdentity) {
+		t.Fatalf("expected ErrAmbiguousIdentity, got %v", err)
+	}
+
+	identity, err := i.BuildIdentity(IdentityQuery{BoardConfig: "d421ap"})
+
+	if err != nil || identity.ApBoardID != "0x06" {
+		t.Fatalf("board config query returned %v, %v", identity, err)
+	}
+}
+
+func TestBuildManifestUnknownKeys(t *testing.T) {
+	data, err := plist.Marshal(map[string]interface{}{
+		"ProductVersion":        "13.0",
+		"SupportedProductTypes": []string{"iPhone12,1"},
+		"ManifestVersion":       1,
+		"BuildIdentities": []interface{}{
+			map[string]interface{}{
+				"ApChipID":      "0x8030",
+				"UniqueBuildID": []byte{0xde, 0xad},
+				"ApProductType": "iPhone12,1",
+				"Info": map[string]interface{}{
+					"DeviceClass":            "n104ap",
+					"MinimumSystemPartition": 4000,
+					"SystemPartitionPadding": map[string]interface{}{"128": 1280},
+					"RestoreBehavior":        "Erase",
+					"MacOSVariant":           "none",
+				},
+				"Manifest": map[string]interface{}{
+					"KernelCache": map[string]interface{}{
+						"Digest":        []byte{0x01, 0x02},
+						"Trusted":       true,
+						"RawDataDigest": []byte{0x03},
+						"Info": map[string]interface{}{
+							"Path": "kernelcache.release.n104",
+							"RestoreRequestRules": []interface{}{
+								map[string]interface{}{"Actions": map[string]interface{}{"EPRO": true}},
+							},
+							"IsKernelCache": true,
+						},
+					},
+				},
+			},
+		},
+	}, plist.XMLFormat)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m BuildManifest
+
+	if _, err := plist.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.ProductVersion != "13.0" || len(m.SupportedProductTypes) != 1 || len(m.Unknown) != 1 || m.Unknown["ManifestVersion"] != uint64(1) {
+		t.Fatalf("manifest decoded as %+v", m)
+	}
+
+	identity := m.BuildIdentities[0]
+
+	if identity.ApChipID != "0x8030" || !bytes.Equal(identity.UniqueBuildID, []byte{0xde, 0xad}) || len(identity.Unknown) != 1 ||
+		identity.Unknown["ApProductType"] != "iPhone12,1" {
+		t.Fatalf("identity decoded as %+v", identity)
+	}
+
+	if info := identity.Info; info.DeviceClass != "n104ap" || info.MinimumSystemPartition != 4000 ||
+		info.SystemPartitionPadding["128"] != 1280 || len(info.Unknown) != 1 || info.Unknown["MacOSVariant"] != "none" {
+		t.Fatalf("identity info decoded as %+v", info)
+	}
+
+	kernel := identity.Manifest["KernelCache"]
+
+	if !kernel.Trusted || !bytes.Equal(kernel.Digest, []byte{0x01, 0x02}) || len(kernel.Unknown) != 1 || kernel.Unknown["RawDataDigest"] == nil {
+		t.Fatalf("component decoded as %+v", kernel)
+	}
+
+	if info := kernel.Info; info.Path != "kernelcache.release.n104" || len(info.RestoreRequestRules) != 1 ||
+		info.RestoreRequestRules[0].Actions["EPRO"] != true || len(info.Unknown) != 1 || info.Unknown["IsKernelCache"] != true {
+		t.Fatalf("component info decoded as %+v", info)
+	}
+
+	wrong, err := plist.Marshal(map[string]interface{}{"BuildIdentities": []interface{}{map[string]interface{}{"ApChipID": 0x8030}}}, plist.XMLFormat)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := plist.Unmarshal(wrong, &m); err == nil {
+		t.Fatal("expected an error decoding an integer into a string field")
+	}
+}
@@ -0,0 +1,279 @@
+package ipsw
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+const (
+	IM4MMagic = "IM4M"
+
+	// manifestBodyTag and manifestPropertiesTag hold the signed body of an IM4M, and the properties of the device it is for.
+	manifestBodyTag       = "MANB"
+	manifestPropertiesTag = "MANP"
+)
+
+// IM4MProperties are the properties of an IM4M, by their four character name.
+// Values are uint64, []byte, bool or string, or IM4MProperties for nested sets.
+type IM4MProperties map[string]interface{}
+
+// Int returns the integer property name.
+func (p IM4MProperties) Int(name string) (uint64, bool) {
+	v, ok := p[name].(uint64)
+
+	return v, ok
+}
+
+// Bytes returns the data property name.
+func (p IM4MProperties) Bytes(name string) ([]byte, bool) {
+	v, ok := p[name].([]byte)
+
+	return v, ok
+}
+
+// Bool returns the boolean property name.
+func (p IM4MProperties) Bool(name string) (bool, bool) {
+	v, ok := p[name].(bool)
+
+	return v, ok
+}
+
+// IM4MComponent is a component signed by an IM4M, e.g. "krnl".
+type IM4MComponent struct {
+	Name string
+
+	// Digest is the hash of the IM4P of the component.
+	Digest     []byte
+	Properties IM4MProperties
+}
+
+// IM4M is an IMG4 manifest, or APTicket: the signed list of components a device may boot.
+type IM4M struct {
+	Version int
+
+	ECID           uint64
+	ApNonce        []byte
+	SepNonce       []byte
+	ChipID         uint64
+	BoardID        uint64
+	SecurityDomain uint64
+	ProductionMode bool
+	SecurityMode   bool
+
+	// Properties are all of the MANP properties, including those above.
+	Properties IM4MProperties
+	Components map[string]*IM4MComponent
+
+	Signature       []byte
+	RawCertificates []byte
+
+	// Raw is the DER of the whole IM4M.
+	Raw []byte
+}
+
+func im4mError(format string, args ...interface{}) error {
+	return &ImageFormatError{Format: IM4MMagic, Err: fmt.Errorf(format, args...)}
+}
+
+// ParseIM4M parses an IM4M.
+func ParseIM4M(data []byte) (*IM4M, error) {
+	elems, err := derSequence(data, IM4MMagic)
+
+	if err != nil {
+		return nil, im4mError("%w", err)
+	}
+
+	if len(elems) < 3 {
+		return nil, im4mError("expected at least 3 elements, got %d", len(elems))
+	}
+
+	m := &IM4M{Raw: data, Components: make(map[string]*IM4MComponent)}
+
+	if _, err := asn1.Unmarshal(elems[1].FullBytes, &m.Version); err != nil {
+		return nil, im4mError("version: %w", err)
+	}
+
+	body, err := parseIM4MSet(elems[2].Bytes)
+
+	if err != nil {
+		return nil, im4mError("%w", err)
+	}
+
+	manb, ok := body[manifestBodyTag].(IM4MProperties)
+
+	if !ok {
+		return nil, im4mError("no %s", manifestBodyTag)
+	}
+
+	for name, value := range manb {
+		props, ok := value.(IM4MProperties)
+
+		if !ok {
+			continue
+		}
+
+		if name == manifestPropertiesTag {
+			m.Properties = props
+			continue
+		}
+
+		digest, _ := props.Bytes("DGST")
+
+		m.Components[name] = &IM4MComponent{Name: name, Digest: digest, Properties: props}
+	}
+
+	if m.Properties == nil {
+		return nil, im4mError("no %s", manifestPropertiesTag)
+	}
+
+	m.ECID, _ = m.Properties.Int("ECID")
+	m.ApNonce, _ = m.Properties.Bytes("BNCH")
+	m.SepNonce, _ = m.Properties.Bytes("snon")
+	m.ChipID, _ = m.Properties.Int("CHIP")
+	m.BoardID, _ = m.Properties.Int("BORD")
+	m.SecurityDomain, _ = m.Properties.Int("SDOM")
+	m.ProductionMode, _ = m.Properties.Bool("CPRO")
+	m.SecurityMode, _ = m.Properties.Bool("CSEC")
+
+	if len(elems) > 3 {
+		if _, err := asn1.Unmarshal(elems[3].FullBytes, &m.Signature); err != nil {
+			return nil, im4mError("signature: %w", err)
+		}
+	}
+
+	if len(elems) > 4 {
+		m.RawCertificates = elems[4].Bytes
+	}
+
+	return m, nil
+}
+
+// parseIM4MSet parses a set of IM4M properties, each of which is a private tag holding a sequence of its name and value.
+func parseIM4MSet(data []byte) (IM4MProperties, error) {
+	elems, err := derElements(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	props := make(IM4MProperties, len(elems))
+
+	for _, elem := range elems {
+		if elem.Class != asn1.ClassPrivate {
+			continue
+		}
+
+		pair, err := derElements(elem.Bytes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pair) != 1 {
+			return nil, errors.New("property is not a sequence")
+		}
+
+		fields, err := derElements(pair[0].Bytes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("property has %d fields", len(fields))
+		}
+
+		var name string
+
+		if _, err := asn1.Unmarshal(fields[0].FullBytes, &name); err != nil {
+			return nil, fmt.Errorf("property name: %w", err)
+		}
+
+		value, err := parseIM4MValue(fields[1])
+
+		if err != nil {
+			return nil, fmt.Errorf("property %s: %w", name, err)
+		}
+
+		props[name] = value
+	}
+
+	return props, nil
+}
+
+func parseIM4MValue(v asn1.RawValue) (interface{}, error) {
+	if v.Class != asn1.ClassUniversal {
+		return v.FullBytes, nil
+	}
+
+	switch v.Tag {
+	case asn1.TagInteger:
+		var i *big.Int
+
+		if _, err := asn1.Unmarshal(v.FullBytes, &i); err != nil {
+			return nil, err
+		}
+
+		return i.Uint64(), nil
+	case asn1.TagBoolean:
+		var b bool
+
+		_, err := asn1.Unmarshal(v.FullBytes, &b)
+
+		return b, err
+	case asn1.TagIA5String, asn1.TagUTF8String, asn1.TagPrintableString:
+		var s string
+
+		_, err := asn1.Unmarshal(v.FullBytes, &s)
+
+		return s, err
+	case asn1.TagOctetString:
+		return v.Bytes, nil
+	case asn1.TagSet:
+		return parseIM4MSet(v.Bytes)
+	default:
+		return v.FullBytes, nil
+	}
+}
+
+// Certificates parses the certificate chain of the manifest, leaf first.
+func (m *IM4M) Certificates() ([]*x509.Certificate, error) {
+	return x509.ParseCertificates(m.RawCertificates)
+}
+
+// Component returns the component with the four character name, e.g. "krnl".
+func (m *IM4M) Component(name string) (*IM4MComponent, error) {
+	c, ok := m.Components[name]
+
+	if !ok {
+		return nil, &ComponentNotFoundError{Component: name}
+	}
+
+	return c, nil
+}
+
+// ComponentNames returns the names of all of the components in the manifest, sorted.
+func (m *IM4M) ComponentNames() []string {
+	names := make([]string, 0, len(m.Components))
+
+	for name := range m.Components {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Manifest parses the IM4M of the IMG4.
+func (i *IMG4) Manifest() (*IM4M, error) {
+	if i.RawManifest == nil {
+		return nil, &ImageFormatError{Format: IMG4Magic, Err: errors.New("no manifest")}
+	}
+
+	return ParseIM4M(i.RawManifest)
+}
@@ -0,0 +1,99 @@
+package ipsw
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testIM4MHex is an IM4M for ECID 0x1234 on CPID 0x8030, BDID 0x04, which signs a krnl.
+var testIM4MHex = strings.Join([]string{
+	"30820109",
+	"1604494d344d", // IM4M
+	"020100",       // version 0
+	"3181f7",
+	"ff84ea859c4281ef3081ec16044d414e423181e3",   // MANB
+	"ff84ea859c5081a33081a016044d414e50318197",   // MANP
+	"ff8492b986480e300c1604424e4348040401020304", // BNCH 01020304
+	"ff8492bda4440b30091604424f5244020104",       // BORD 0x04
+	"ff849aa192500d300b1604434849500203008030",   // CHIP 0x8030
+	"ff849ac1a44f0b300916044350524f0101ff",       // CPRO true
+	"ff849acd8a430b30091604435345430101ff",       // CSEC true
+	"ff84aa8d92440c300a16044543494402021234",     // ECID 0x1234
+	"ff859a919e4d0b3009160453444f4d020101",       // SDOM 0x01
+	"ff879bb9de6e0c300a1604736e6f6e04020506",     // snon 0506
+	"ff86dbc9dc6c31302f16046b726e6c3127",         // krnl
+	"ff84a29da6540e300c1604444753540404deadbeef", // DGST deadbeef
+	"ff84aac1a44f0b300916044550524f0101ff",       // EPRO true
+	"040473696721",                               // signature
+}, "")
+
+func testIM4M(t *testing.T) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(testIM4MHex)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestParseIM4M(t *testing.T) {
+	m, err := ParseIM4M(testIM4M(t))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Version != 0 || m.ECID != 0x1234 || m.ChipID != 0x8030 || m.BoardID != 0x04 || m.SecurityDomain != 0x01 ||
+		!m.ProductionMode || !m.SecurityMode {
+		t.Fatalf("parsed IM4M %+v", m)
+	}
+
+	if fmt.Sprintf("%x %x %s", m.ApNonce, m.SepNonce, m.Signature) != "01020304 0506 sig!" {
+		t.Fatalf("parsed nonces %x and %x, and signature %q", m.ApNonce, m.SepNonce, m.Signature)
+	}
+
+	if len(m.Properties) != 8 || len(m.RawCertificates) != 0 {
+		t.Fatalf("parsed %d properties and %d bytes of certificates", len(m.Properties), len(m.RawCertificates))
+	}
+
+	if names := m.ComponentNames(); len(names) != 1 || names[0] != "krnl" {
+		t.Fatalf("parsed components %v", names)
+	}
+
+	krnl, err := m.Component("krnl")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if epro, ok := krnl.Properties.Bool("EPRO"); fmt.Sprintf("%x", krnl.Digest) != "deadbeef" || !epro || !ok {
+		t.Fatalf("parsed krnl %+v", krnl)
+	}
+
+	var notFound *ComponentNotFoundError
+
+	if _, err := m.Component("rkrn"); !errors.Is(err, ErrComponentNotFound) || !errors.As(err, &notFound) || notFound.Identifier != "" {
+		t.Fatalf("expected a ComponentNotFoundError without an identifier, got %v", err)
+	}
+}
+
+func TestParseIM4MInvalid(t *testing.T) {
+	data := testIM4M(t)
+
+	for name, data := range map[string][]byte{
+		"truncated": data[:len(data)-1],
+		"IM4P":      testIM4P(t),
+		// the MANP tag renamed to MANQ
+		"no MANP": []byte(strings.Replace(string(data), "\x04MANP", "\x04MANQ", 1)),
+	} {
+		if _, err := ParseIM4M(data); !errors.Is(err, ErrBadImage) {
+			t.Errorf("%s: expected ErrBadImage, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package ipsw
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	IMG4Magic = "IMG4"
+	IM4PMagic = "IM4P"
+)
+
+// CompressionAlgorithm is the compression of an IM4P payload, as stored in the IM4P.
+type CompressionAlgorithm int
+
+const (
+	CompressionLZFSE CompressionAlgorithm = 1
+)
+
+// IM4PCompression describes a payload which was compressed before it was encrypted.
+type IM4PCompression struct {
+	Algorithm        CompressionAlgorithm
+	UncompressedSize int
+}
+
+// IM4P is an IMG4 payload: a typed, optionally encrypted and compressed, firmware image.
+type IM4P struct {
+	// Type is the four character type of the payload, e.g. "krnl" or "ibot".
+	Type        string
+	Description string
+	Data        []byte
+
+	// KeyBags are only present if Data is encrypted.
+	KeyBags     []KeyBag
+	Compression *IM4PCompression
+}
+
+// IMG4 is a payload along with the manifest it is signed by, as stored on a device.
+type IMG4 struct {
+	Payload *IM4P
+
+	// RawManifest is the DER of the IM4M, if present.
+	RawManifest []byte
+
+	// RawRestoreInfo is the DER of the IM4R, if present.
+	RawRestoreInfo []byte
+}
+
+type im4pKeybag struct {
+	Type int
+	IV   []byte
+	Key  []byte
+}
+
+type im4pCompression struct {
+	Algorithm        int
+	UncompressedSize int
+}
+
+func im4pError(format string, args ...interface{}) error {
+	return &ImageFormatError{Format: IM4PMagic, Err: fmt.Errorf(format, args...)}
+}
+
+// derElements splits data into the DER elements it contains.
+func derElements(data []byte) ([]asn1.RawValue, error) {
+	var elems []asn1.RawValue
+
+	for rest := data; len(rest) > 0; {
+		var elem asn1.RawValue
+		var err error
+
+		rest, err = asn1.Unmarshal(rest, &elem)
+
+		if err != nil {
+			return nil, err
+		}
+
+		elems = append(elems, elem)
+	}
+
+	return elems, nil
+}
+
+// derSequence splits the DER SEQUENCE in data into its elements, checking that it starts with magic.
+func derSequence(data []byte, magic string) ([]asn1.RawValue, error) {
+	var seq asn1.RawValue
+
+	if _, err := asn1.Unmarshal(data, &seq); err != nil {
+		return nil, err
+	}
+
+	if seq.Class != asn1.ClassUniversal || seq.Tag != asn1.TagSequence {
+		return nil, errors.New("not a sequence")
+	}
+
+	elems, err := derElements(seq.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(elems) == 0 {
+		return nil, errors.New("empty sequence")
+	}
+
+	var m string
+
+	if _, err := asn1.Unmarshal(elems[0].FullBytes, &m); err != nil || m != magic {
+		return nil, fmt.Errorf("bad magic, expected %s", magic)
+	}
+
+	return elems, nil
+}
+
+// ParseIM4P parses an IM4P, or the payload of an IMG4.
+func ParseIM4P(data []byte) (*IM4P, error) {
+	elems, err := derSequence(data, IM4PMagic)
+
+	if err != nil {
+		if img4, err4 := ParseIMG4(data); err4 == nil {
+			return img4.Payload, nil
+		}
+
+		return nil, im4pError("%w", err)
+	}
+
+	if len(elems) < 4 {
+		return nil, im4pError("expected at least 4 elements, got %d", len(elems))
+	}
+
+	im4p := new(IM4P)
+
+	if _, err := asn1.Unmarshal(elems[1].FullBytes, &im4p.Type); err != nil {
+		return nil, im4pError("type: %w", err)
+	}
+
+	if _, err := asn1.Unmarshal(elems[2].FullBytes, &im4p.Description); err != nil {
+		return nil, im4pError("description: %w", err)
+	}
+
+	if _, err := asn1.Unmarshal(elems[3].FullBytes, &im4p.Data); err != nil {
+		return nil, im4pError("data: %w", err)
+	}
+
+	for _, elem := range elems[4:] {
+		if elem.Class != asn1.ClassUniversal {
+			// properties added in later versions
+			continue
+		}
+
+		switch elem.Tag {
+		case asn1.TagOctetString:
+			var keybags []im4pKeybag
+
+			if _, err := asn1.Unmarshal(elem.Bytes, &keybags); err != nil {
+				return nil, im4pError("keybags: %w", err)
+			}
+
+			for _, kbag := range keybags {
+				im4p.KeyBags = append(im4p.KeyBags, KeyBag{
+					Type:    KBagType(kbag.Type),
+					AESBits: 8 * len(kbag.Key),
+					IV:      kbag.IV,
+					Key:     kbag.Key,
+					RawKey:  kbag.Key,
+				})
+			}
+		case asn1.TagSequence:
+			var compression im4pCompression
+
+			if _, err := asn1.Unmarshal(elem.FullBytes, &compression); err != nil {
+				return nil, im4pError("compression: %w", err)
+			}
+
+			im4p.Compression = &IM4PCompression{
+				Algorithm:        CompressionAlgorithm(compression.Algorithm),
+				UncompressedSize: compression.UncompressedSize,
+			}
+		}
+	}
+
+	return im4p, nil
+}
+
+// ReadIM4P reads all of r and parses it as an IM4P.
+func ReadIM4P(r io.Reader) (*IM4P, error) {
+	data, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseIM4P(data)
+}
+
+// ParseIMG4 parses an IMG4, which wraps an IM4P with its IM4M and IM4R.
+func ParseIMG4(data []byte) (*IMG4, error) {
+	elems, err := derSequence(data, IMG4Magic)
+
+	if err != nil {
+		return nil, &ImageFormatError{Format: IMG4Magic, Err: err}
+	}
+
+	if len(elems) < 2 {
+		return nil, &ImageFormatError{Format: IMG4Magic, Err: errors.New("no payload")}
+	}
+
+	payload, err := ParseIM4P(elems[1].FullBytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	img4 := &IMG4{Payload: payload}
+
+	for _, elem := range elems[2:] {
+		if elem.Class != asn1.ClassContextSpecific {
+			continue
+		}
+
+		switch elem.Tag {
+		case 0:
+			img4.RawManifest = elem.Bytes
+		case 1:
+			img4.RawRestoreInfo = elem.Bytes
+		}
+	}
+
+	return img4, nil
+}
+
+// KeyBag returns the key bag of type t.
+func (p *IM4P) KeyBag(t KBagType) (*KeyBag, error) {
+	for i := range p.KeyBags {
+		if p.KeyBags[i].Type == t {
+			return &p.KeyBags[i], nil
+		}
+	}
+
+	return nil, &ElementNotFoundError{Signature: KbagElement}
+}
+
+// KBag returns the production key bag of the IM4P as hex, in the same form as KBag.
+func (p *IM4P) KBag() (string, error) {
+	kbag, err := p.KeyBag(ProductionKBag)
+
+	if err != nil {
+		return "", err
+	}
+
+	return kbag.String(), nil
+}
+
+// IM4PKBag is the equivalent of KBag for IM4P images.
+func IM4PKBag(data io.Reader) (string, error) {
+	im4p, err := ReadIM4P(data)
+
+	if err != nil {
+		return "", err
+	}
+
+	return im4p.KBag()
+}
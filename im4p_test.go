@@ -0,0 +1,104 @@
+package ipsw
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testIM4PHex is a krnl IM4P with a production AES-256 and a development AES-128 key bag,
+// and a payload compressed with LZFSE.
+var testIM4PHex = strings.Join([]string{
+	"308191",
+	"1604494d3450",               // IM4P
+	"16046b726e6c",               // krnl
+	"160b4b65726e656c4361636865", // KernelCache
+	"04077061796c6f6164",         // payload
+	// key bags: production, with IV 00..0f and key 10..2f, and development, with IV 30..3f and key 40..4f
+	"0464306230370201010410000102030405060708090a0b0c0d0e0f0420101112131415161718191a1b1c1d1e1f20212223242526272829" +
+		"2a2b2c2d2e2f30270201020410303132333435363738393a3b3c3d3e3f0410404142434445464748494a4b4c4d4e4f",
+	"300702010102024000", // LZFSE, 0x4000 bytes uncompressed
+}, "")
+
+func testIM4P(t *testing.T) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(testIM4PHex)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestParseIM4P(t *testing.T) {
+	im4p, err := ParseIM4P(testIM4P(t))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if im4p.Type != "krnl" || im4p.Description != "KernelCache" || string(im4p.Data) != "payload" {
+		t.Fatalf("parsed %s %s with data %q", im4p.Type, im4p.Description, im4p.Data)
+	}
+
+	if c := im4p.Compression; c == nil || c.Algorithm != CompressionLZFSE || c.UncompressedSize != 0x4000 {
+		t.Fatalf("parsed compression %+v", c)
+	}
+
+	if len(im4p.KeyBags) != 2 {
+		t.Fatalf("parsed %d key bags", len(im4p.KeyBags))
+	}
+
+	production, err := im4p.KeyBag(ProductionKBag)
+
+	if err != nil || production.AESBits != 256 || production.IV[0] != 0x00 || production.Key[0] != 0x10 || len(production.Key) != 32 {
+		t.Fatalf("production key bag is %+v, %v", production, err)
+	}
+
+	development, err := im4p.KeyBag(DevelopmentKBag)
+
+	if err != nil || development.AESBits != 128 || development.IV[0] != 0x30 || development.Key[0] != 0x40 || len(development.Key) != 16 {
+		t.Fatalf("development key bag is %+v, %v", development, err)
+	}
+
+	kbag, err := IM4PKBag(bytes.NewReader(testIM4P(t)))
+
+	if want := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f"; err != nil || kbag != want {
+		t.Fatalf("kbag is %s, %v, expected %s", kbag, err, want)
+	}
+
+	if _, err := im4p.KeyBag(KBagType(3)); !errors.Is(err, ErrElementNotFound) {
+		t.Fatalf("expected ErrElementNotFound, got %v", err)
+	}
+}
+
+func TestParseIMG4(t *testing.T) {
+	manifest, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: []byte("manifest")})
+	magic, _ := asn1.MarshalWithParams(IMG4Magic, "ia5")
+	img4, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true,
+		Bytes: append(append(magic, testIM4P(t)...), manifest...)})
+
+	parsed, err := ParseIMG4(img4)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Payload.Type != "krnl" || string(parsed.RawManifest) != "manifest" || parsed.RawRestoreInfo != nil {
+		t.Fatalf("parsed %s payload with manifest %q", parsed.Payload.Type, parsed.RawManifest)
+	}
+
+	// the payload of an IMG4 can be parsed as an IM4P
+	if im4p, err := ParseIM4P(img4); err != nil || len(im4p.KeyBags) != 2 {
+		t.Fatalf("parsed IMG4 as IM4P %+v, %v", im4p, err)
+	}
+
+	if _, err := ParseIM4P([]byte("IM4P")); !errors.Is(err, ErrBadImage) {
+		t.Fatalf("expected ErrBadImage, got %v", err)
+	}
+}
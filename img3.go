@@ -0,0 +1,449 @@
+package ipsw
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	img3HeaderSize        = 20
+	img3ElementHeaderSize = 12
+
+	VersElement ElementType = 0x56455253 // VERS
+	SaltElement ElementType = 0x53414C54 // SALT
+)
+
+// String returns the four character name of the element type, e.g. "DATA".
+func (e ElementType) String() string {
+	var b [4]byte
+
+	binary.BigEndian.PutUint32(b[:], uint32(e))
+
+	return string(b[:])
+}
+
+func img3Error(format string, args ...interface{}) error {
+	return &ImageFormatError{Format: "IMG3", Err: fmt.Errorf(format, args...)}
+}
+
+// IMG3Element is a tag of an IMG3 image.
+type IMG3Element struct {
+	Signature ElementType
+	Data      []byte
+
+	// Padding follows Data, to align the element to 4 bytes.
+	Padding []byte
+}
+
+// Header returns the header the element is written with.
+func (e *IMG3Element) Header() ImageElementHeader {
+	return ImageElementHeader{
+		Signature: uint32(e.Signature),
+		FullSize:  uint32(img3ElementHeaderSize + len(e.Data) + len(e.Padding)),
+		DataSize:  uint32(len(e.Data)),
+	}
+}
+
+// IMG3Reader reads the elements of an IMG3 image in order.
+type IMG3Reader struct {
+	// Header is the header of the image, or nil if the reader is reading a run of elements
+	// without one, such as an SHSH blob.
+	Header *ImageHeader
+
+	r         *bufio.Reader
+	remaining int64
+}
+
+// NewIMG3Reader returns a reader of the elements of the IMG3 in r.
+// If r does not start with an IMG3 header, it is read as a run of elements up to EOF.
+func NewIMG3Reader(r io.Reader) (*IMG3Reader, error) {
+	ir := &IMG3Reader{r: bufio.NewReader(r), remaining: -1}
+
+	magic, err := ir.r.Peek(4)
+
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(magic) == 4 && ImageContainer(binary.LittleEndian.Uint32(magic)) == Img3Container {
+		var header ImageHeader
+
+		if err := binary.Read(ir.r, binary.LittleEndian, &header); err != nil {
+			return nil, img3Error("header: %w", err)
+		}
+
+		if header.FullSize < img3HeaderSize || header.DataSize > header.FullSize-img3HeaderSize {
+			return nil, img3Error("data size %d doesn't fit in image of %d bytes", header.DataSize, header.FullSize)
+		}
+
+		if header.ShshOffset > header.DataSize {
+			return nil, img3Error("signed area %d is larger than data %d", header.ShshOffset, header.DataSize)
+		}
+
+		ir.Header = &header
+		ir.remaining = int64(header.DataSize)
+	}
+
+	return ir, nil
+}
+
+// Next returns the next element of the image, or io.EOF once every element has been read.
+func (r *IMG3Reader) Next() (*IMG3Element, error) {
+	if r.remaining == 0 {
+		return nil, io.EOF
+	}
+
+	var header ImageElementHeader
+
+	if err := binary.Read(r.r, binary.LittleEndian, &header); err == io.EOF && r.remaining < 0 {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, img3Error("element header: %w", err)
+	}
+
+	if header.FullSize < img3ElementHeaderSize || header.DataSize > header.FullSize-img3ElementHeaderSize {
+		return nil, img3Error("element %s has data size %d and full size %d", ElementType(header.Signature), header.DataSize, header.FullSize)
+	}
+
+	if r.remaining >= 0 {
+		if int64(header.FullSize) > r.remaining {
+			return nil, img3Error("element %s overruns the image", ElementType(header.Signature))
+		}
+
+		r.remaining -= int64(header.FullSize)
+	}
+
+	elem := &IMG3Element{Signature: ElementType(header.Signature)}
+
+	var err error
+
+	if elem.Data, err = readIMG3Data(r.r, header.DataSize); err != nil {
+		return nil, img3Error("element %s: %w", elem.Signature, err)
+	}
+
+	if elem.Padding, err = readIMG3Data(r.r, header.FullSize-img3ElementHeaderSize-header.DataSize); err != nil {
+		return nil, img3Error("element %s: %w", elem.Signature, err)
+	}
+
+	return elem, nil
+}
+
+// img3ReadChunk is the most that is allocated for element data before any of it has been read.
+const img3ReadChunk = 64 << 10
+
+// readIMG3Data reads n bytes from r. The buffer grows as the data arrives rather than being sized
+// from n up front, as n comes from the image and a short image would otherwise still cost an allocation of n bytes.
+func readIMG3Data(r io.Reader, n uint32) ([]byte, error) {
+	size := n
+
+	if size > img3ReadChunk {
+		size = img3ReadChunk
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+
+	if _, err := io.CopyN(buf, r, int64(n)); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// IMG3 is a parsed IMG3 image, which can be changed and written out again.
+type IMG3 struct {
+	// ImageType is the type of the image, e.g. "krnl", stored as an ElementType.
+	ImageType ElementType
+	Elements  []*IMG3Element
+}
+
+// ParseIMG3 parses every element of an IMG3 image.
+func ParseIMG3(data []byte) (*IMG3, error) {
+	return ReadIMG3(bytes.NewReader(data))
+}
+
+// ReadIMG3 reads and parses an IMG3 image from r.
+func ReadIMG3(r io.Reader) (*IMG3, error) {
+	ir, err := NewIMG3Reader(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ir.Header == nil {
+		return nil, img3Error("bad magic")
+	}
+
+	img3 := &IMG3{ImageType: ElementType(ir.Header.ImageType)}
+
+	for {
+		elem, err := ir.Next()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		img3.Elements = append(img3.Elements, elem)
+	}
+
+	return img3, nil
+}
+
+// Element returns the first element with signature.
+func (i *IMG3) Element(signature ElementType) (*IMG3Element, error) {
+	for _, elem := range i.Elements {
+		if elem.Signature == signature {
+			return elem, nil
+		}
+	}
+
+	return nil, &ElementNotFoundError{Signature: signature}
+}
+
+// ElementsOf returns every element with signature, in order.
+func (i *IMG3) ElementsOf(signature ElementType) []*IMG3Element {
+	var elems []*IMG3Element
+
+	for _, elem := range i.Elements {
+		if elem.Signature == signature {
+			elems = append(elems, elem)
+		}
+	}
+
+	return elems
+}
+
+// SetElement replaces the data of the first element with signature, or adds a new element before the
+// signature elements if there is none. The element is padded to 4 bytes.
+func (i *IMG3) SetElement(signature ElementType, data []byte) {
+	elem, err := i.Element(signature)
+
+	if err != nil {
+		elem = &IMG3Element{Signature: signature}
+
+		at := i.signedEnd()
+		i.Elements = append(i.Elements[:at], append([]*IMG3Element{elem}, i.Elements[at:]...)...)
+	}
+
+	elem.Data = data
+	elem.Padding = make([]byte, (4-len(data)%4)%4)
+}
+
+// RemoveElements removes every element with signature.
+func (i *IMG3) RemoveElements(signature ElementType) {
+	elems := i.Elements[:0]
+
+	for _, elem := range i.Elements {
+		if elem.Signature != signature {
+			elems = append(elems, elem)
+		}
+	}
+
+	i.Elements = elems
+}
+
+// signedEnd returns the index of the first element which is not covered by the signature.
+func (i *IMG3) signedEnd() int {
+	for n, elem := range i.Elements {
+		if elem.Signature == ShshElement || elem.Signature == CertElement {
+			return n
+		}
+	}
+
+	return len(i.Elements)
+}
+
+// Header returns the header the image is written with. ShshOffset is the size of the elements before the SHSH element.
+func (i *IMG3) Header() ImageHeader {
+	var size, signed uint32
+
+	end := i.signedEnd()
+
+	for n, elem := range i.Elements {
+		size += elem.Header().FullSize
+
+		if n < end {
+			signed = size
+		}
+	}
+
+	return ImageHeader{
+		Signature:  uint32(Img3Container),
+		FullSize:   img3HeaderSize + size,
+		DataSize:   size,
+		ShshOffset: signed,
+		ImageType:  uint32(i.ImageType),
+	}
+}
+
+// WriteTo writes the image to w, with sizes recalculated from its elements.
+func (i *IMG3) WriteTo(w io.Writer) (int64, error) {
+	buf := new(bytes.Buffer)
+
+	header := i.Header()
+	binary.Write(buf, binary.LittleEndian, &header)
+
+	for _, elem := range i.Elements {
+		elemHeader := elem.Header()
+		binary.Write(buf, binary.LittleEndian, &elemHeader)
+		buf.Write(elem.Data)
+		buf.Write(elem.Padding)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// Bytes returns the image as it is written by WriteTo.
+func (i *IMG3) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	i.WriteTo(buf)
+
+	return buf.Bytes()
+}
+
+// Uint32 decodes the first element with signature as a 32-bit integer, as used by SEPO, BORD, CHIP, SDOM and PROD.
+func (i *IMG3) Uint32(signature ElementType) (uint32, error) {
+	elem, err := i.Element(signature)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(elem.Data) < 4 {
+		return 0, img3Error("element %s is too short", signature)
+	}
+
+	return binary.LittleEndian.Uint32(elem.Data), nil
+}
+
+// Type returns the value of the TYPE element, e.g. "krnl".
+func (i *IMG3) Type() (string, error) {
+	t, err := i.Uint32(TypeElement)
+
+	if err != nil {
+		return "", err
+	}
+
+	return ElementType(t).String(), nil
+}
+
+// Version returns the value of the VERS element, e.g. "iBoot-1219.62.15".
+func (i *IMG3) Version() (string, error) {
+	elem, err := i.Element(VersElement)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(elem.Data) < 4 {
+		return "", img3Error("element VERS is too short")
+	}
+
+	n := binary.LittleEndian.Uint32(elem.Data)
+
+	if uint64(n) > uint64(len(elem.Data)-4) {
+		return "", img3Error("element VERS overruns its data")
+	}
+
+	return string(elem.Data[4 : 4+n]), nil
+}
+
+// SecurityEpoch returns the value of the SEPO element.
+func (i *IMG3) SecurityEpoch() (uint32, error) {
+	return i.Uint32(SepoElement)
+}
+
+// BoardID returns the value of the BORD element.
+func (i *IMG3) BoardID() (uint32, error) {
+	return i.Uint32(BordElement)
+}
+
+// ChipID returns the value of the CHIP element.
+func (i *IMG3) ChipID() (uint32, error) {
+	return i.Uint32(ChipElement)
+}
+
+// SecurityDomain returns the value of the SDOM element.
+func (i *IMG3) SecurityDomain() (uint32, error) {
+	return i.Uint32(SdomElement)
+}
+
+// ProductionMode returns the value of the PROD element.
+func (i *IMG3) ProductionMode() (uint32, error) {
+	return i.Uint32(ProdElement)
+}
+
+// ECID returns the value of the ECID element of a personalised image.
+func (i *IMG3) ECID() (uint64, error) {
+	elem, err := i.Element(EcidElement)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(elem.Data) < 8 {
+		return 0, img3Error("element ECID is too short")
+	}
+
+	return binary.LittleEndian.Uint64(elem.Data), nil
+}
+
+// IMG3Signature is the signature of a personalised IMG3 image: the ECID, SHSH and CERT elements
+// at its end. SHSH blobs for IMG3 devices hold just these elements for each component.
+type IMG3Signature struct {
+	ECID            uint64
+	Signature       []byte
+	RawCertificates []byte
+}
+
+// ParseIMG3Signature parses the signature elements of an IMG3 image, or of an IMG3 SHSH blob.
+func ParseIMG3Signature(data []byte) (*IMG3Signature, error) {
+	r, err := NewIMG3Reader(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	sig := new(IMG3Signature)
+	found := false
+
+	for {
+		elem, err := r.Next()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch elem.Signature {
+		case EcidElement:
+			if len(elem.Data) >= 8 {
+				sig.ECID = binary.LittleEndian.Uint64(elem.Data)
+			}
+		case ShshElement:
+			sig.Signature = elem.Data
+			found = true
+		case CertElement:
+			sig.RawCertificates = elem.Data
+		}
+	}
+
+	if !found {
+		return nil, &ElementNotFoundError{Signature: ShshElement}
+	}
+
+	return sig, nil
+}
+
+// Certificates parses the certificate chain of the signature.
+func (s *IMG3Signature) Certificates() ([]*x509.Certificate, error) {
+	return x509.ParseCertificates(s.RawCertificates)
+}
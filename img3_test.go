@@ -0,0 +1,139 @@
+package ipsw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+)
+
+// testIMG3 builds a krnl image with TYPE, VERS, DATA, SHSH and CERT elements.
+func testIMG3() []byte {
+	vers := append(leUint32(uint32(len("iBoot-1219.62.15"))), "iBoot-1219.62.15"...)
+
+	elems := img3Elements(
+		&IMG3Element{Signature: TypeElement, Data: leUint32(0x6b726e6c)},
+		&IMG3Element{Signature: VersElement, Data: vers},
+		&IMG3Element{Signature: DataElement, Data: []byte("kernel"), Padding: []byte{0, 0}},
+		&IMG3Element{Signature: ShshElement, Data: make([]byte, 128)},
+		&IMG3Element{Signature: CertElement, Data: []byte{0x30, 0x00}, Padding: []byte{0, 0}},
+	)
+
+	buf := new(bytes.Buffer)
+
+	binary.Write(buf, binary.LittleEndian, &ImageHeader{
+		Signature:  uint32(Img3Container),
+		FullSize:   uint32(img3HeaderSize + len(elems)),
+		DataSize:   uint32(len(elems)),
+		ShshOffset: uint32(len(elems) - 2*img3ElementHeaderSize - 128 - 4),
+		ImageType:  0x6b726e6c,
+	})
+
+	buf.Write(elems)
+
+	return buf.Bytes()
+}
+
+func TestIMG3RoundTrip(t *testing.T) {
+	data := testIMG3()
+
+	img3, err := ParseIMG3(data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img3.ImageType.String() != "krnl" || len(img3.Elements) != 5 {
+		t.Fatalf("parsed %s image with %d elements", img3.ImageType, len(img3.Elements))
+	}
+
+	if !bytes.Equal(img3.Bytes(), data) {
+		t.Fatal("unmodified image was not written back unchanged")
+	}
+
+	img3.SetElement(DataElement, []byte("patched kernel"))
+	img3.SetElement(BordElement, leUint32(0x0e))
+	img3.RemoveElements(CertElement)
+
+	buf := new(bytes.Buffer)
+
+	if _, err := img3.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	reparsed, err := ParseIMG3(buf.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signatures []string
+
+	for _, elem := range reparsed.Elements {
+		signatures = append(signatures, elem.Signature.String())
+	}
+
+	if got := fmt.Sprint(signatures); got != "[TYPE VERS DATA BORD SHSH]" {
+		t.Fatalf("rewritten image has elements %s", got)
+	}
+
+	elem, err := reparsed.Element(DataElement)
+
+	if err != nil || string(elem.Data) != "patched kernel" || len(elem.Padding) != 2 {
+		t.Fatalf("rewritten DATA element is %+v, %v", elem, err)
+	}
+
+	if version, err := reparsed.Version(); err != nil || version != "iBoot-1219.62.15" {
+		t.Fatalf("rewritten image has version %q, %v", version, err)
+	}
+
+	if board, err := reparsed.BoardID(); err != nil || board != 0x0e {
+		t.Fatalf("rewritten image has board %#x, %v", board, err)
+	}
+
+	header := reparsed.Header()
+	shsh, _ := reparsed.Element(ShshElement)
+
+	if int(header.ShshOffset) != int(header.DataSize)-int(shsh.Header().FullSize) || int(header.FullSize) != buf.Len() {
+		t.Fatalf("rewritten image has header %+v for %d bytes", header, buf.Len())
+	}
+}
+
+func TestIMG3ElementSizeFromInput(t *testing.T) {
+	// an element claiming almost 4GiB of data, with none following it
+	elem := new(bytes.Buffer)
+	binary.Write(elem, binary.LittleEndian, &ImageElementHeader{Signature: uint32(DataElement), FullSize: 0xfffff000, DataSize: 0xffffeff0})
+
+	r, err := NewIMG3Reader(bytes.NewReader(elem.Bytes()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+	_, err = r.Next()
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrBadImage) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected an unexpected EOF, got %v", err)
+	}
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("reading a 12 byte element allocated %d bytes", allocated)
+	}
+
+	// the same element inside an image whose header claims to hold it
+	data := make([]byte, img3HeaderSize)
+	binary.LittleEndian.PutUint32(data, uint32(Img3Container))
+	binary.LittleEndian.PutUint32(data[4:], 0xffffffff)
+	binary.LittleEndian.PutUint32(data[8:], 0xffffffff-img3HeaderSize)
+
+	if _, err := ParseIMG3(append(data, elem.Bytes()...)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected an unexpected EOF, got %v", err)
+	}
+}
@@ -1,12 +1,15 @@
 package ipsw
 
 import (
-	"bufio"
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"net/http"
+	"reflect"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cj123/go-ipsw/api"
 	"howett.net/plist"
@@ -22,6 +25,17 @@ type BuildManifest struct {
 	SupportedProductTypes []string
 	ProductVersion        string
 	ProductBuildVersion   string
+
+	// Unknown holds any keys of the manifest which have no field.
+	Unknown map[string]interface{} `plist:"-"`
+}
+
+func (b *BuildManifest) UnmarshalPlist(unmarshal func(interface{}) error) error {
+	return unmarshalPlistWithUnknown(unmarshal, b)
+}
+
+func (b *BuildManifest) unmarshalPlistDict(dict map[string]interface{}) error {
+	return fillPlistStruct(dict, reflect.ValueOf(b).Elem(), &b.Unknown)
 }
 
 type Restore struct {
@@ -40,7 +54,7 @@ func (r *Restore) DeviceByIdentifier(identifier Identifier) (*Device, error) {
 		device = r.Devices[0]
 	} else {
 		for deviceIndex, restoreDevice := range r.SupportedProductTypes {
-			if restoreDevice == identifier {
+			if restoreDevice == identifier && deviceIndex < len(r.Devices) {
 				device = r.Devices[deviceIndex]
 				break
 			}
@@ -48,10 +62,10 @@ func (r *Restore) DeviceByIdentifier(identifier Identifier) (*Device, error) {
 	}
 
 	if device == nil {
-		if r.ProductType == identifier {
+		if r.ProductType == identifier && len(r.Devices) > 0 {
 			device = r.Devices[0]
 		} else {
-			return nil, fmt.Errorf("ipsw: unable to find identifier: %s in Restore.plist", identifier)
+			return nil, &IdentifierNotFoundError{Identifier: identifier, In: RestoreFilename}
 		}
 	}
 
@@ -82,34 +96,334 @@ type BuildIdentity struct {
 	// RawManifest                        interface{}           `plist:"Manifest"`
 	UniqueBuildID []byte
 	BbSkeyId      []byte
+
+	// Unknown holds any keys of the identity which have no field.
+	Unknown map[string]interface{} `plist:"-"`
+}
+
+func (b *BuildIdentity) UnmarshalPlist(unmarshal func(interface{}) error) error {
+	return unmarshalPlistWithUnknown(unmarshal, b)
+}
+
+func (b *BuildIdentity) unmarshalPlistDict(dict map[string]interface{}) error {
+	return fillPlistStruct(dict, reflect.ValueOf(b).Elem(), &b.Unknown)
 }
 
 type BuildIdentityInfo struct {
-	BuildNumber     string
-	BuildTrain      string
-	DeviceClass     string
-	Variant         string
-	RestoreBehavior string
+	BuildNumber            string
+	BuildTrain             string
+	CodeName               string
+	DeviceClass            string
+	Variant                string
+	VariantContents        map[string]string
+	RestoreBehavior        string
+	FDRSupport             bool
+	MinimumSystemPartition int
+	SystemPartitionPadding map[string]int
+	OSVarContentSize       int
+	MobileDeviceMinVersion string
+	RestoreRamDisk         string
+
+	// Unknown holds any keys of the info which have no field.
+	Unknown map[string]interface{} `plist:"-"`
+}
+
+func (b *BuildIdentityInfo) UnmarshalPlist(unmarshal func(interface{}) error) error {
+	return unmarshalPlistWithUnknown(unmarshal, b)
+}
+
+func (b *BuildIdentityInfo) unmarshalPlistDict(dict map[string]interface{}) error {
+	return fillPlistStruct(dict, reflect.ValueOf(b).Elem(), &b.Unknown)
 }
 
 type BuildIdentityManifest map[string]Manifest
 
+// Manifest is a component of a build identity, e.g. KernelCache.
 type Manifest struct {
-	Info ManifestInfo
+	Info          ManifestInfo
+	Digest        []byte
+	PartialDigest []byte
+	BuildString   string
+	Trusted       bool
+	EPRO          bool
+	ESEC          bool
+
+	// Unknown holds any keys of the component which have no field.
+	Unknown map[string]interface{} `plist:"-"`
+}
+
+func (m *Manifest) UnmarshalPlist(unmarshal func(interface{}) error) error {
+	return unmarshalPlistWithUnknown(unmarshal, m)
+}
+
+func (m *Manifest) unmarshalPlistDict(dict map[string]interface{}) error {
+	return fillPlistStruct(dict, reflect.ValueOf(m).Elem(), &m.Unknown)
 }
 
 type ManifestInfo struct {
-	Path string
+	Path                        string
+	IsFirmwarePayload           bool
+	IsSecondaryFirmwarePayload  bool
+	IsLoadedByiBoot             bool
+	IsLoadedByiBootStage1       bool
+	IsiBootEANFirmware          bool
+	IsiBootNonEssentialFirmware bool
+	IsEarlyAccessFirmware       bool
+	IsFUDFirmware               bool
+	IsFTAB                      bool
+	Personalize                 bool
+	RestoreRequestRules         []RestoreRequestRule
+
+	// Unknown holds any keys of the info which have no field.
+	Unknown map[string]interface{} `plist:"-"`
+}
+
+func (m *ManifestInfo) UnmarshalPlist(unmarshal func(interface{}) error) error {
+	return unmarshalPlistWithUnknown(unmarshal, m)
+}
+
+func (m *ManifestInfo) unmarshalPlistDict(dict map[string]interface{}) error {
+	return fillPlistStruct(dict, reflect.ValueOf(m).Elem(), &m.Unknown)
+}
+
+// RestoreRequestRule sets Actions on a TSS request for a component when all of its Conditions hold.
+type RestoreRequestRule struct {
+	Actions    map[string]interface{}
+	Conditions map[string]interface{}
+}
+
+// plistDictUnmarshaler is implemented by the manifest types which keep the keys they have no field for.
+// They are filled from the dictionary the plist decodes to, so however deeply they are nested, the plist
+// is decoded once.
+type plistDictUnmarshaler interface {
+	unmarshalPlistDict(dict map[string]interface{}) error
+}
+
+// unmarshalPlistWithUnknown decodes a plist dictionary and fills v from it.
+func unmarshalPlistWithUnknown(unmarshal func(interface{}) error, v plistDictUnmarshaler) error {
+	var dict map[string]interface{}
+
+	if err := unmarshal(&dict); err != nil {
+		return err
+	}
+
+	return v.unmarshalPlistDict(dict)
+}
+
+// fillPlistStruct fills the fields of the struct v from dict, and stores any keys which v has no field for
+// in unknown, if it is not nil.
+func fillPlistStruct(dict map[string]interface{}, v reflect.Value, unknown *map[string]interface{}) error {
+	t := v.Type()
+	known := make(map[string]bool, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		key, ok := plistKey(t.Field(i))
+
+		if !ok {
+			continue
+		}
+
+		known[key] = true
+
+		if err := fillPlistValue(v.Field(i), dict[key]); err != nil {
+			return err
+		}
+	}
+
+	if unknown == nil {
+		return nil
+	}
+
+	for key, value := range dict {
+		if known[key] {
+			continue
+		}
+
+		if *unknown == nil {
+			*unknown = make(map[string]interface{})
+		}
+
+		(*unknown)[key] = value
+	}
+
+	return nil
 }
 
+// fillPlistValue sets v to value, which is as a plist decodes into an interface{}, following the rules
+// howett.net/plist uses to decode into v itself.
+func fillPlistValue(v reflect.Value, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+
+		v = v.Elem()
+	}
+
+	mismatch := fmt.Errorf("ipsw: cannot decode plist %T into %s", value, v.Type())
+
+	if u, ok := v.Addr().Interface().(plistDictUnmarshaler); ok {
+		dict, ok := value.(map[string]interface{})
+
+		if !ok {
+			return mismatch
+		}
+
+		return u.unmarshalPlistDict(dict)
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return mismatch
+		}
+
+		v.Set(reflect.ValueOf(value))
+	case reflect.String:
+		s, ok := value.(string)
+
+		if !ok {
+			return mismatch
+		}
+
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := value.(bool)
+
+		if !ok {
+			return mismatch
+		}
+
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch n := value.(type) {
+		case uint64:
+			v.SetInt(int64(n))
+		case int64:
+			v.SetInt(n)
+		default:
+			return mismatch
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch n := value.(type) {
+		case uint64:
+			v.SetUint(n)
+		case int64:
+			v.SetUint(uint64(n))
+		default:
+			return mismatch
+		}
+	case reflect.Float32, reflect.Float64:
+		switch n := value.(type) {
+		case float64:
+			v.SetFloat(n)
+		case float32:
+			v.SetFloat(float64(n))
+		default:
+			return mismatch
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, ok := value.([]byte)
+
+			if !ok {
+				return mismatch
+			}
+
+			v.SetBytes(b)
+
+			return nil
+		}
+
+		items, ok := value.([]interface{})
+
+		if !ok {
+			return mismatch
+		}
+
+		v.Set(reflect.MakeSlice(v.Type(), len(items), len(items)))
+
+		for i, item := range items {
+			if err := fillPlistValue(v.Index(i), item); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		dict, ok := value.(map[string]interface{})
+
+		if !ok || v.Type().Key().Kind() != reflect.String {
+			return mismatch
+		}
+
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+
+		for key, item := range dict {
+			elem := reflect.New(v.Type().Elem()).Elem()
+
+			if err := fillPlistValue(elem, item); err != nil {
+				return err
+			}
+
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			t, ok := value.(time.Time)
+
+			if !ok {
+				return mismatch
+			}
+
+			v.Set(reflect.ValueOf(t))
+
+			return nil
+		}
+
+		dict, ok := value.(map[string]interface{})
+
+		if !ok {
+			return mismatch
+		}
+
+		return fillPlistStruct(dict, v, nil)
+	default:
+		return mismatch
+	}
+
+	return nil
+}
+
+// plistKey returns the plist key of field, or false if it has none.
+func plistKey(field reflect.StructField) (string, bool) {
+	name := strings.Split(field.Tag.Get("plist"), ",")[0]
+
+	if name == "-" || field.PkgPath != "" {
+		return "", false
+	} else if name == "" {
+		name = field.Name
+	}
+
+	return name, true
+}
+
+// IPSW is a firmware file. An IPSW is safe for concurrent use once created: its zip directory,
+// manifests and headers are each fetched once, however many goroutines ask for them at the same time.
+// The values returned are shared between callers, so must not be modified.
 type IPSW struct {
-	Identifier  string
-	BuildID     string
-	Resource    string
-	manifest    *BuildManifest
-	rawManifest map[string]interface{}
-	restore     *Restore
-	headers     http.Header
+	Identifier string
+	BuildID    string
+	Resource   string
+
+	client   *Client
+	sourceMu sync.Mutex
+	source   Source
+	loads    loadGroup
 }
 
 func NewIPSW(identifier, build, resource string) *IPSW {
@@ -121,129 +435,215 @@ func NewIPSW(identifier, build, resource string) *IPSW {
 }
 
 func NewIPSWWithIdentifierBuild(client *api.IPSWClient, identifier, build string) (*IPSW, error) {
-	resource, err := client.URL(identifier, build)
+	return NewIPSWWithIdentifierBuildContext(context.Background(), client, identifier, build)
+}
+
+func NewIPSWWithIdentifierBuildContext(ctx context.Context, client *api.IPSWClient, identifier, build string) (*IPSW, error) {
+	resource, err := client.URLContext(ctx, identifier, build)
 
 	if err != nil {
 		return nil, err
 	} else if resource == "" {
-		return nil, errors.New("ipsw: firmware not found (potentially beta)")
+		return nil, ErrFirmwareNotFound
 	}
 
 	return NewIPSW(identifier, build, resource), nil
 }
 
-func (i *IPSW) PlistFromZip(name string, out interface{}) error {
-	buf := new(bytes.Buffer)
-	writer := bufio.NewWriter(buf)
+// NewIPSWWithSource creates an IPSW which is read from src rather than a URL,
+// for example a local file or an io.ReaderAt.
+func NewIPSWWithSource(identifier, build string, src Source) *IPSW {
+	return &IPSW{
+		Identifier: identifier,
+		BuildID:    build,
+		Resource:   sourceName(src),
+		source:     src,
+	}
+}
+
+// getClient returns the Client the IPSW was created with, or the default client.
+func (i *IPSW) getClient() *Client {
+	if i.client == nil {
+		return defaultClient()
+	}
+
+	return i.client
+}
+
+func (i *IPSW) getSource() (Source, error) {
+	i.sourceMu.Lock()
+	defer i.sourceMu.Unlock()
+
+	if i.source == nil {
+		src, err := i.getClient().NewSource(i.Resource)
 
-	err := DownloadFile(i.Resource, name, writer)
+		if err != nil {
+			return nil, err
+		}
+
+		i.source = src
+	}
+
+	return i.source, nil
+}
+
+// zip returns the central directory of the IPSW, fetching it on first use.
+// The same directory is shared by all later extractions.
+func (i *IPSW) zip(ctx context.Context) (*zipArchive, error) {
+	z, err := i.loads.load(ctx, "zip", func(ctx context.Context) (interface{}, error) {
+		src, err := i.getSource()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return openZip(ctx, src, i.getClient().options(nil))
+	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = plist.Unmarshal(buf.Bytes(), out)
+	return z.(*zipArchive), nil
+}
 
-	return err
+// Close releases any files held open by the IPSW's source.
+func (i *IPSW) Close() error {
+	i.sourceMu.Lock()
+	defer i.sourceMu.Unlock()
+
+	if i.source == nil {
+		return nil
+	}
+
+	return closeSource(i.source)
 }
 
-func (i *IPSW) Headers() (http.Header, error) {
-	if i.headers != nil {
-		return i.headers, nil
+func (i *IPSW) PlistFromZip(name string, out interface{}) error {
+	return i.PlistFromZipContext(context.Background(), name, out)
+}
+
+func (i *IPSW) PlistFromZipContext(ctx context.Context, name string, out interface{}) error {
+	zipReader, err := i.zip(ctx)
+
+	if err != nil {
+		return err
 	}
 
-	res, err := DefaultClient.Get(i.Resource)
+	buf := new(bytes.Buffer)
+
+	err = zipReader.extract(ctx, name, buf)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defer res.Body.Close()
+	_, err = plist.Unmarshal(buf.Bytes(), out)
 
-	i.headers = res.Header
+	return err
+}
 
-	return res.Header, err
+func (i *IPSW) Headers() (http.Header, error) {
+	return i.HeadersContext(context.Background())
 }
 
-func (i *IPSW) BuildManifest() (*BuildManifest, error) {
-	if i.manifest != nil {
-		return i.manifest, nil
-	}
+// HeadersContext returns the HTTP headers of the IPSW. Local files are given a Content-Length and
+// Last-Modified from disk, any other source which is not remote returns a NotHTTPSourceError.
+func (i *IPSW) HeadersContext(ctx context.Context) (http.Header, error) {
+	headers, err := i.loads.load(ctx, "headers", func(ctx context.Context) (interface{}, error) {
+		src, err := i.getSource()
+
+		if err != nil {
+			return nil, err
+		}
+
+		h, ok := src.(headerSource)
 
-	var manifest BuildManifest
+		if !ok {
+			return nil, &NotHTTPSourceError{Resource: sourceName(src)}
+		}
 
-	err := i.PlistFromZip(BuildManifestFilename, &manifest)
+		return h.headers(ctx)
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	i.manifest = &manifest
+	return headers.(http.Header), nil
+}
 
-	return &manifest, err
+func (i *IPSW) BuildManifest() (*BuildManifest, error) {
+	return i.BuildManifestContext(context.Background())
 }
 
-func (i *IPSW) RawManifest() (map[string]interface{}, error) {
-	if i.rawManifest != nil {
-		return i.rawManifest, nil
-	}
+func (i *IPSW) BuildManifestContext(ctx context.Context) (*BuildManifest, error) {
+	manifest, err := i.loads.load(ctx, "manifest", func(ctx context.Context) (interface{}, error) {
+		var manifest BuildManifest
 
-	var manifest map[string]interface{}
+		err := i.PlistFromZipContext(ctx, BuildManifestFilename, &manifest)
 
-	err := i.PlistFromZip(BuildManifestFilename, &manifest)
+		return &manifest, err
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	i.rawManifest = manifest
+	return manifest.(*BuildManifest), nil
+}
 
-	return manifest, err
+func (i *IPSW) RawManifest() (map[string]interface{}, error) {
+	return i.RawManifestContext(context.Background())
 }
 
-func (i *IPSW) RestorePlist() (*Restore, error) {
-	if i.restore != nil {
-		return i.restore, nil
-	}
+func (i *IPSW) RawManifestContext(ctx context.Context) (map[string]interface{}, error) {
+	manifest, err := i.loads.load(ctx, "raw-manifest", func(ctx context.Context) (interface{}, error) {
+		var manifest map[string]interface{}
 
-	var restore Restore
+		err := i.PlistFromZipContext(ctx, BuildManifestFilename, &manifest)
 
-	err := i.PlistFromZip(RestoreFilename, &restore)
+		return manifest, err
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	i.restore = &restore
+	return manifest.(map[string]interface{}), nil
+}
 
-	return &restore, err
+func (i *IPSW) RestorePlist() (*Restore, error) {
+	return i.RestorePlistContext(context.Background())
 }
 
-var basebandRegex = regexp.MustCompile("[0-9]{2}.[0-9]{2}.[0-9]{2}")
+func (i *IPSW) RestorePlistContext(ctx context.Context) (*Restore, error) {
+	restore, err := i.loads.load(ctx, "restore", func(ctx context.Context) (interface{}, error) {
+		var restore Restore
 
-func (i IPSW) Baseband() (string, error) {
-	manifest, err := i.BuildManifest()
+		err := i.PlistFromZipContext(ctx, RestoreFilename, &restore)
+
+		return &restore, err
+	})
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	productIndex := -1
+	return restore.(*Restore), nil
+}
 
-	for index, productType := range manifest.SupportedProductTypes {
-		if productType == i.Identifier {
-			productIndex = index
-		}
-	}
+var basebandRegex = regexp.MustCompile("[0-9]{2}.[0-9]{2}.[0-9]{2}")
 
-	if productIndex == -1 {
-		return "", errors.New("ipsw: unable to find identifier in given IPSW")
-	}
+func (i *IPSW) Baseband() (string, error) {
+	return i.BasebandContext(context.Background())
+}
 
-	baseband, ok := manifest.BuildIdentities[productIndex].Manifest["BasebandFirmware"]
+func (i *IPSW) BasebandContext(ctx context.Context) (string, error) {
+	baseband, err := i.ComponentContext(ctx, "BasebandFirmware")
 
-	if !ok {
-		return "", errors.New("ipsw: baseband not found in IPSW")
+	if err != nil {
+		return "", err
 	}
 
 	return basebandRegex.FindString(baseband.Info.Path), nil
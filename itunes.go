@@ -1,7 +1,7 @@
 package ipsw
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -81,12 +81,25 @@ func (vm *iTunesVersionMaster) GetSoftwareURLFor(identifier string) (string, err
 		}
 	}
 
-	return "", errors.New("Unable to find identifier")
+	return "", &IdentifierNotFoundError{Identifier: Identifier(identifier), In: "iTunes version master"}
 }
 
 // NewiTunesVersionMaster creates a new iTunesVersionMaster struct, parsed and ready to use
 func NewiTunesVersionMaster(url string) (*iTunesVersionMaster, error) {
-	resp, err := DefaultClient.Get(fmt.Sprintf("%s?%d", url, rand.Int()))
+	return defaultClient().NewiTunesVersionMaster(url)
+}
+
+// NewiTunesVersionMasterContext creates a new iTunesVersionMaster struct, fetching url with ctx.
+func NewiTunesVersionMasterContext(ctx context.Context, url string) (*iTunesVersionMaster, error) {
+	return defaultClient().NewiTunesVersionMasterContext(ctx, url)
+}
+
+func (c *Client) NewiTunesVersionMaster(url string) (*iTunesVersionMaster, error) {
+	return c.NewiTunesVersionMasterContext(context.Background(), url)
+}
+
+func (c *Client) NewiTunesVersionMasterContext(ctx context.Context, url string) (*iTunesVersionMaster, error) {
+	resp, err := c.get(ctx, fmt.Sprintf("%s?%d", url, rand.Int()))
 
 	if err != nil {
 		return nil, err
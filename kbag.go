@@ -44,6 +44,8 @@ type ImageKbagElement struct {
 	Key          [32]byte
 }
 
+// FindElement scans data four bytes at a time for an element with signature, and reads it into out.
+// The scan can match inside the data of other elements; use NewIMG3Reader or ParseIMG3 to walk the elements of an image.
 func FindElement(data *bufio.Reader, signature ElementType, out interface{}) error {
 	for {
 		b, err := data.Peek(4)
@@ -62,7 +64,7 @@ func FindElement(data *bufio.Reader, signature ElementType, out interface{}) err
 		data.Discard(4)
 	}
 
-	return fmt.Errorf("element with signature: %d not found", signature)
+	return &ElementNotFoundError{Signature: signature}
 }
 
 // KBag finds the kbag for a byte array.
@@ -77,3 +79,137 @@ func KBag(data *bufio.Reader) (string, error) {
 
 	return fmt.Sprintf("%x", append(elem.IV[:], elem.Key[:]...)), nil
 }
+
+// KBagType is the kind of key a key bag holds, the State of an IMG3 KBAG.
+type KBagType int
+
+const (
+	ProductionKBag  KBagType = 1
+	DevelopmentKBag KBagType = 2
+)
+
+func (t KBagType) String() string {
+	switch t {
+	case ProductionKBag:
+		return "production"
+	case DevelopmentKBag:
+		return "development"
+	default:
+		return fmt.Sprintf("KBagType(%d)", int(t))
+	}
+}
+
+// AES types of an IMG3 KBAG.
+const (
+	AES128 uint32 = 0x80
+	AES192 uint32 = 0xc0
+	AES256 uint32 = 0x100
+)
+
+// KeyBag is the encrypted IV and key for the payload of an IMG3 or IM4P.
+type KeyBag struct {
+	Type KBagType
+
+	// AESBits is the size of the key: 128, 192 or 256.
+	AESBits int
+	IV      []byte
+
+	// Key is the key, trimmed to AESBits.
+	Key []byte
+
+	// RawKey is the key field as it is stored. For IMG3 it is always 32 bytes.
+	RawKey []byte
+}
+
+// String returns the IV and the key field as it is stored as hex, in the same form as KBag.
+func (k KeyBag) String() string {
+	return fmt.Sprintf("%x%x", k.IV, k.RawKey)
+}
+
+// newIMG3KeyBag decodes the data of an IMG3 KBAG element.
+func newIMG3KeyBag(data []byte) (*KeyBag, error) {
+	const size = 8 + 16 + 32
+
+	if len(data) < size {
+		return nil, img3Error("element KBAG is too short")
+	}
+
+	state := binary.LittleEndian.Uint32(data)
+	aesType := binary.LittleEndian.Uint32(data[4:])
+
+	var bits int
+
+	switch aesType {
+	case AES128:
+		bits = 128
+	case AES192:
+		bits = 192
+	case AES256:
+		bits = 256
+	default:
+		return nil, img3Error("unknown KBAG AES type %#x", aesType)
+	}
+
+	return &KeyBag{
+		Type:    KBagType(state),
+		AESBits: bits,
+		IV:      data[8:24],
+		Key:     data[24 : 24+bits/8],
+		RawKey:  data[24:56],
+	}, nil
+}
+
+// KeyBags returns every KBAG of the image, in order.
+func (i *IMG3) KeyBags() ([]KeyBag, error) {
+	var kbags []KeyBag
+
+	for _, elem := range i.ElementsOf(KbagElement) {
+		kbag, err := newIMG3KeyBag(elem.Data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		kbags = append(kbags, *kbag)
+	}
+
+	return kbags, nil
+}
+
+// KeyBags returns every key bag of an IMG3, IM4P or IMG4 image.
+func KeyBags(data []byte) ([]KeyBag, error) {
+	if len(data) >= 4 && ImageContainer(binary.LittleEndian.Uint32(data)) == Img3Container {
+		img3, err := ParseIMG3(data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return img3.KeyBags()
+	}
+
+	im4p, err := ParseIM4P(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return im4p.KeyBags, nil
+}
+
+// KeyBag returns the KBAG of type t.
+func (i *IMG3) KeyBag(t KBagType) (*KeyBag, error) {
+	kbags, err := i.KeyBags()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for n := range kbags {
+		if kbags[n].Type == t {
+			return &kbags[n], nil
+		}
+	}
+
+	return nil, &ElementNotFoundError{Signature: KbagElement}
+}
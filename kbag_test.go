@@ -0,0 +1,95 @@
+package ipsw
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testIMG3KeyBag builds the data of an IMG3 KBAG element, with the IV and key counting up from start.
+func testIMG3KeyBag(state KBagType, aesType uint32, start byte) []byte {
+	data := append(leUint32(uint32(state)), leUint32(aesType)...)
+
+	for i := 0; i < 16+32; i++ {
+		data = append(data, start+byte(i))
+	}
+
+	return data
+}
+
+func TestKeyBagsIMG3(t *testing.T) {
+	img3 := &IMG3{ImageType: ElementType(0x6b726e6c)}
+	img3.SetElement(DataElement, []byte("kernel"))
+	img3.Elements = append(img3.Elements,
+		&IMG3Element{Signature: KbagElement, Data: testIMG3KeyBag(ProductionKBag, AES256, 0x00)},
+		&IMG3Element{Signature: KbagElement, Data: testIMG3KeyBag(DevelopmentKBag, AES128, 0x40)},
+	)
+
+	kbags, err := KeyBags(img3.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+
+	for _, kbag := range kbags {
+		got = append(got, fmt.Sprintf("%s %d %x %x", kbag.Type, kbag.AESBits, kbag.IV[0], kbag.Key))
+	}
+
+	want := []string{
+		"production 256 0 101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f",
+		"development 128 40 505152535455565758595a5b5c5d5e5f",
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("key bags are %q, expected %q", got, want)
+	}
+
+	// String gives the same as KBag, which reads the first KBAG with all 32 bytes of its key, whatever the AES type
+	legacy, err := KBag(bufio.NewReader(bytes.NewReader(img3.Bytes())))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if kbags[0].String() != legacy || len(kbags[1].String()) != len(legacy) {
+		t.Fatalf("key bags print as %s and %s, and KBag as %s", kbags[0], kbags[1], legacy)
+	}
+
+	development, err := img3.KeyBag(DevelopmentKBag)
+
+	if err != nil || development.Key[0] != 0x50 {
+		t.Fatalf("development key bag is %+v, %v", development, err)
+	}
+
+	img3.RemoveElements(KbagElement)
+
+	if _, err := img3.KeyBag(ProductionKBag); !errors.Is(err, ErrElementNotFound) {
+		t.Fatalf("expected ErrElementNotFound, got %v", err)
+	}
+
+	img3.SetElement(KbagElement, testIMG3KeyBag(ProductionKBag, 0x40, 0x00))
+
+	if _, err := img3.KeyBags(); !errors.Is(err, ErrBadImage) {
+		t.Fatalf("expected ErrBadImage for an unknown AES type, got %v", err)
+	}
+}
+
+func TestKeyBagsIM4P(t *testing.T) {
+	kbags, err := KeyBags(testIM4P(t))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kbags) != 2 || kbags[0].Type != ProductionKBag || kbags[1].Type != DevelopmentKBag {
+		t.Fatalf("key bags are %+v", kbags)
+	}
+
+	if want := "303132333435363738393a3b3c3d3e3f404142434445464748494a4b4c4d4e4f"; kbags[1].String() != want {
+		t.Fatalf("development key bag prints as %s, expected %s", kbags[1], want)
+	}
+}
@@ -0,0 +1,83 @@
+package ipsw
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// loadGroup loads values by key at most once. Concurrent loads of the same key are merged
+// into one call, and successful results are kept for later callers. Failed loads are not kept,
+// so the next caller tries again. The zero value is ready to use.
+type loadGroup struct {
+	mu     sync.Mutex
+	calls  map[string]*loadCall
+	values map[string]interface{}
+}
+
+type loadCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// load returns the value for key, calling fn with ctx if it has not been loaded yet.
+// A caller waiting on another caller's load stops waiting when its own ctx is done.
+func (g *loadGroup) load(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	for {
+		g.mu.Lock()
+
+		if value, ok := g.values[key]; ok {
+			g.mu.Unlock()
+			return value, nil
+		}
+
+		if call, ok := g.calls[key]; ok {
+			g.mu.Unlock()
+
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+
+			if isContextError(call.err) && ctx.Err() == nil {
+				// the caller making the load gave up, but this one hasn't
+				continue
+			}
+
+			return call.value, call.err
+		}
+
+		call := &loadCall{done: make(chan struct{})}
+
+		if g.calls == nil {
+			g.calls = make(map[string]*loadCall)
+		}
+
+		g.calls[key] = call
+		g.mu.Unlock()
+
+		call.value, call.err = fn(ctx)
+
+		g.mu.Lock()
+		delete(g.calls, key)
+
+		if call.err == nil {
+			if g.values == nil {
+				g.values = make(map[string]interface{})
+			}
+
+			g.values[key] = call.value
+		}
+
+		g.mu.Unlock()
+		close(call.done)
+
+		return call.value, call.err
+	}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
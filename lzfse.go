@@ -0,0 +1,628 @@
+package ipsw
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+const (
+	lzfseEndOfStreamMagic = "bvx$"
+	lzfseRawBlockMagic    = "bvx-"
+	lzfseV1BlockMagic     = "bvx1"
+	lzfseV2BlockMagic     = "bvx2"
+	lzvnBlockMagic        = "bvxn"
+
+	lzfseV1HeaderSize = 772
+	lzfseV2HeaderSize = 32
+	lzvnHeaderSize    = 12
+
+	lzfseLSymbols       = 20
+	lzfseMSymbols       = 20
+	lzfseDSymbols       = 64
+	lzfseLiteralSymbols = 256
+
+	lzfseLStates       = 64
+	lzfseMStates       = 64
+	lzfseDStates       = 256
+	lzfseLiteralStates = 1024
+
+	lzfseMatchesPerBlock  = 10000
+	lzfseLiteralsPerBlock = 4 * lzfseMatchesPerBlock
+)
+
+var (
+	lzfseLExtraBits = [lzfseLSymbols]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 3, 5, 8}
+	lzfseMExtraBits = [lzfseMSymbols]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 5, 8, 11}
+	lzfseDExtraBits = func() (b [lzfseDSymbols]uint8) {
+		for i := range b {
+			b[i] = uint8(i / 4)
+		}
+
+		return b
+	}()
+
+	lzfseLBaseValue = lzfseBaseValues(lzfseLExtraBits[:])
+	lzfseMBaseValue = lzfseBaseValues(lzfseMExtraBits[:])
+	lzfseDBaseValue = lzfseBaseValues(lzfseDExtraBits[:])
+)
+
+// lzfseBaseValues returns the smallest value of each symbol, given the number of extra bits each symbol has.
+func lzfseBaseValues(extraBits []uint8) []int32 {
+	base := make([]int32, len(extraBits))
+
+	for i := 1; i < len(base); i++ {
+		base[i] = base[i-1] + 1<<extraBits[i-1]
+	}
+
+	return base
+}
+
+func lzfseError(format string, args ...interface{}) error {
+	return &ImageFormatError{Format: "LZFSE", Err: fmt.Errorf(format, args...)}
+}
+
+// DecompressLZFSE decompresses an LZFSE stream, as used by bvx2 kernelcaches and payloads.
+// The stream may contain LZFSE, LZVN and uncompressed blocks.
+func DecompressLZFSE(data []byte) ([]byte, error) {
+	var out []byte
+
+	for {
+		if len(data) < 4 {
+			return nil, lzfseError("stream has no end of stream block")
+		}
+
+		var (
+			n   int
+			err error
+		)
+
+		switch string(data[:4]) {
+		case lzfseEndOfStreamMagic:
+			return out, nil
+		case lzfseRawBlockMagic:
+			if len(data) < 8 {
+				return nil, lzfseError("truncated block header")
+			}
+
+			size := int(binary.LittleEndian.Uint32(data[4:]))
+
+			if size > len(data)-8 {
+				return nil, lzfseError("truncated uncompressed block")
+			}
+
+			out = append(out, data[8:8+size]...)
+			n = 8 + size
+		case lzvnBlockMagic:
+			if len(data) < lzvnHeaderSize {
+				return nil, lzfseError("truncated block header")
+			}
+
+			size := int(binary.LittleEndian.Uint32(data[4:]))
+			payloadSize := int(binary.LittleEndian.Uint32(data[8:]))
+
+			if payloadSize > len(data)-lzvnHeaderSize {
+				return nil, lzfseError("truncated lzvn block")
+			}
+
+			out, err = decompressLZVN(out, data[lzvnHeaderSize:lzvnHeaderSize+payloadSize], size)
+			n = lzvnHeaderSize + payloadSize
+		case lzfseV1BlockMagic, lzfseV2BlockMagic:
+			var header *lzfseBlockHeader
+
+			header, n, err = parseLZFSEBlockHeader(data)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if header.payloadSize() > len(data)-n {
+				return nil, lzfseError("truncated block")
+			}
+
+			out, err = header.decode(out, data[n:n+header.payloadSize()])
+			n += header.payloadSize()
+		default:
+			return nil, lzfseError("unknown block magic %q", data[:4])
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		data = data[n:]
+	}
+}
+
+// lzfseBlockHeader is the header of a compressed LZFSE block, with v2 headers unpacked into the v1 layout.
+type lzfseBlockHeader struct {
+	rawSize            int
+	literals           int
+	matches            int
+	literalPayloadSize int
+	lmdPayloadSize     int
+	literalBits        int
+	literalState       [4]uint16
+	lmdBits            int
+	lState             uint16
+	mState             uint16
+	dState             uint16
+	lFreq              [lzfseLSymbols]uint16
+	mFreq              [lzfseMSymbols]uint16
+	dFreq              [lzfseDSymbols]uint16
+	literalFreq        [lzfseLiteralSymbols]uint16
+}
+
+func (h *lzfseBlockHeader) payloadSize() int {
+	return h.literalPayloadSize + h.lmdPayloadSize
+}
+
+// freqs returns every frequency table of the header, in the order they are stored.
+func (h *lzfseBlockHeader) freqs() []*uint16 {
+	freqs := make([]*uint16, 0, lzfseLSymbols+lzfseMSymbols+lzfseDSymbols+lzfseLiteralSymbols)
+
+	for _, table := range [][]uint16{h.lFreq[:], h.mFreq[:], h.dFreq[:], h.literalFreq[:]} {
+		for i := range table {
+			freqs = append(freqs, &table[i])
+		}
+	}
+
+	return freqs
+}
+
+// parseLZFSEBlockHeader parses the header of a bvx1 or bvx2 block, returning it and its size.
+func parseLZFSEBlockHeader(data []byte) (*lzfseBlockHeader, int, error) {
+	h := new(lzfseBlockHeader)
+
+	if string(data[:4]) == lzfseV1BlockMagic {
+		if len(data) < lzfseV1HeaderSize {
+			return nil, 0, lzfseError("truncated block header")
+		}
+
+		u32 := func(off int) int { return int(binary.LittleEndian.Uint32(data[off:])) }
+		u16 := func(off int) uint16 { return binary.LittleEndian.Uint16(data[off:]) }
+
+		h.rawSize = u32(4)
+		h.literals = u32(12)
+		h.matches = u32(16)
+		h.literalPayloadSize = u32(20)
+		h.lmdPayloadSize = u32(24)
+		h.literalBits = int(int32(u32(28)))
+
+		for i := range h.literalState {
+			h.literalState[i] = u16(32 + 2*i)
+		}
+
+		h.lmdBits = int(int32(u32(40)))
+		h.lState = u16(44)
+		h.mState = u16(46)
+		h.dState = u16(48)
+
+		for i, freq := range h.freqs() {
+			*freq = u16(50 + 2*i)
+		}
+
+		return h, lzfseV1HeaderSize, h.check()
+	}
+
+	if len(data) < lzfseV2HeaderSize {
+		return nil, 0, lzfseError("truncated block header")
+	}
+
+	field := func(v uint64, offset, n uint) int {
+		return int((v >> offset) & (1<<n - 1))
+	}
+
+	v0 := binary.LittleEndian.Uint64(data[8:])
+	v1 := binary.LittleEndian.Uint64(data[16:])
+	v2 := binary.LittleEndian.Uint64(data[24:])
+
+	h.rawSize = int(binary.LittleEndian.Uint32(data[4:]))
+	h.literals = field(v0, 0, 20)
+	h.literalPayloadSize = field(v0, 20, 20)
+	h.matches = field(v0, 40, 20)
+	h.literalBits = field(v0, 60, 3) - 7
+
+	for i := range h.literalState {
+		h.literalState[i] = uint16(field(v1, uint(10*i), 10))
+	}
+
+	h.lmdPayloadSize = field(v1, 40, 20)
+	h.lmdBits = field(v1, 60, 3) - 7
+
+	headerSize := field(v2, 0, 32)
+	h.lState = uint16(field(v2, 32, 10))
+	h.mState = uint16(field(v2, 42, 10))
+	h.dState = uint16(field(v2, 52, 10))
+
+	if headerSize < lzfseV2HeaderSize || headerSize > len(data) {
+		return nil, 0, lzfseError("bad header size %d", headerSize)
+	}
+
+	if headerSize > lzfseV2HeaderSize {
+		if err := h.decodeFreqs(data[lzfseV2HeaderSize:headerSize]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return h, headerSize, h.check()
+}
+
+var (
+	lzfseFreqBits  = [32]int8{2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14, 2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14}
+	lzfseFreqValue = [32]int8{0, 2, 1, 4, 0, 3, 1, -1, 0, 2, 1, 5, 0, 3, 1, -1, 0, 2, 1, 6, 0, 3, 1, -1, 0, 2, 1, 7, 0, 3, 1, -1}
+)
+
+// decodeFreqs decodes the variable length frequency tables of a v2 header.
+func (h *lzfseBlockHeader) decodeFreqs(src []byte) error {
+	var (
+		accum     uint32
+		accumBits int
+	)
+
+	for _, freq := range h.freqs() {
+		for len(src) > 0 && accumBits+8 <= 32 {
+			accum |= uint32(src[0]) << accumBits
+			accumBits += 8
+			src = src[1:]
+		}
+
+		n := int(lzfseFreqBits[accum&31])
+
+		switch n {
+		case 8:
+			*freq = uint16(8 + (accum>>4)&0xf)
+		case 14:
+			*freq = uint16(24 + (accum>>4)&0x3ff)
+		default:
+			*freq = uint16(lzfseFreqValue[accum&31])
+		}
+
+		if n > accumBits {
+			return lzfseError("truncated frequency tables")
+		}
+
+		accum >>= n
+		accumBits -= n
+	}
+
+	if accumBits >= 8 || len(src) > 0 {
+		return lzfseError("bad frequency tables")
+	}
+
+	return nil
+}
+
+func (h *lzfseBlockHeader) check() error {
+	if h.literals > lzfseLiteralsPerBlock || h.matches > lzfseMatchesPerBlock {
+		return lzfseError("too many literals or matches")
+	}
+
+	if h.literalBits < -7 || h.literalBits > 0 || h.lmdBits < -7 || h.lmdBits > 0 {
+		return lzfseError("bad bit counts")
+	}
+
+	for _, state := range h.literalState {
+		if state >= lzfseLiteralStates {
+			return lzfseError("bad literal state")
+		}
+	}
+
+	if h.lState >= lzfseLStates || h.mState >= lzfseMStates || h.dState >= lzfseDStates {
+		return lzfseError("bad lmd state")
+	}
+
+	for _, table := range []struct {
+		freqs  []uint16
+		states int
+	}{
+		{h.lFreq[:], lzfseLStates},
+		{h.mFreq[:], lzfseMStates},
+		{h.dFreq[:], lzfseDStates},
+		{h.literalFreq[:], lzfseLiteralStates},
+	} {
+		sum := 0
+
+		for _, f := range table.freqs {
+			sum += int(f)
+		}
+
+		if sum > table.states {
+			return lzfseError("frequencies exceed states")
+		}
+	}
+
+	return nil
+}
+
+// fseInStream reads bits backwards from the end of a buffer, as written by an FSE encoder.
+type fseInStream struct {
+	accum     uint64
+	accumBits int
+	buf       []byte
+}
+
+func newFSEInStream(buf []byte, n int) (*fseInStream, error) {
+	s := &fseInStream{buf: buf}
+	size := 7
+
+	if n != 0 {
+		size = 8
+	}
+
+	if len(s.buf) < size {
+		return nil, lzfseError("truncated payload")
+	}
+
+	s.buf, s.accum = s.buf[:len(s.buf)-size], readUint64LE(s.buf[len(s.buf)-size:])
+	s.accumBits = n + 8*size
+
+	if s.accumBits < 56 || s.accumBits >= 64 || s.accum>>uint(s.accumBits) != 0 {
+		return nil, lzfseError("bad payload")
+	}
+
+	return s, nil
+}
+
+// flush refills the accumulator so that at least 56 bits can be pulled.
+func (s *fseInStream) flush() error {
+	nbits := (63 - s.accumBits) &^ 7
+	n := nbits >> 3
+
+	if n > len(s.buf) {
+		return lzfseError("truncated payload")
+	}
+
+	incoming := readUint64LE(s.buf[len(s.buf)-n:])
+	s.buf = s.buf[:len(s.buf)-n]
+
+	s.accum = s.accum<<uint(nbits) | incoming
+	s.accumBits += nbits
+
+	return nil
+}
+
+func (s *fseInStream) pull(n int) uint64 {
+	s.accumBits -= n
+	result := s.accum >> uint(s.accumBits)
+	s.accum &= 1<<uint(s.accumBits) - 1
+
+	return result
+}
+
+// readUint64LE reads up to 8 bytes as a little endian integer.
+func readUint64LE(b []byte) uint64 {
+	var v uint64
+
+	for i, c := range b {
+		v |= uint64(c) << (8 * uint(i))
+	}
+
+	return v
+}
+
+type fseDecoderEntry struct {
+	k      int
+	symbol uint8
+	delta  int
+}
+
+func newFSEDecoderTable(states int, freqs []uint16) []fseDecoderEntry {
+	table := make([]fseDecoderEntry, 0, states)
+	nClz := bits.LeadingZeros32(uint32(states))
+
+	for symbol, freq := range freqs {
+		f := int(freq)
+
+		if f == 0 {
+			continue
+		}
+
+		k := bits.LeadingZeros32(uint32(f)) - nClz
+		j0 := ((2 * states) >> uint(k)) - f
+
+		for j := 0; j < f; j++ {
+			e := fseDecoderEntry{symbol: uint8(symbol)}
+
+			if j < j0 {
+				e.k = k
+				e.delta = ((f + j) << uint(k)) - states
+			} else {
+				e.k = k - 1
+				e.delta = (j - j0) << uint(k-1)
+			}
+
+			table = append(table, e)
+		}
+	}
+
+	return table
+}
+
+func (s *fseInStream) decode(state *int, table []fseDecoderEntry) (uint8, error) {
+	if *state >= len(table) {
+		return 0, lzfseError("bad state")
+	}
+
+	e := table[*state]
+	*state = e.delta + int(s.pull(e.k))
+
+	return e.symbol, nil
+}
+
+type fseValueDecoderEntry struct {
+	totalBits int
+	valueBits int
+	delta     int
+	base      int32
+}
+
+func newFSEValueDecoderTable(states int, freqs []uint16, extraBits []uint8, base []int32) []fseValueDecoderEntry {
+	table := make([]fseValueDecoderEntry, 0, states)
+	nClz := bits.LeadingZeros32(uint32(states))
+
+	for symbol, freq := range freqs {
+		f := int(freq)
+
+		if f == 0 {
+			continue
+		}
+
+		k := bits.LeadingZeros32(uint32(f)) - nClz
+		j0 := ((2 * states) >> uint(k)) - f
+
+		for j := 0; j < f; j++ {
+			e := fseValueDecoderEntry{valueBits: int(extraBits[symbol]), base: base[symbol]}
+
+			if j < j0 {
+				e.totalBits = k + e.valueBits
+				e.delta = ((f + j) << uint(k)) - states
+			} else {
+				e.totalBits = k - 1 + e.valueBits
+				e.delta = (j - j0) << uint(k-1)
+			}
+
+			table = append(table, e)
+		}
+	}
+
+	return table
+}
+
+func (s *fseInStream) decodeValue(state *int, table []fseValueDecoderEntry) (int32, error) {
+	if *state >= len(table) {
+		return 0, lzfseError("bad state")
+	}
+
+	e := table[*state]
+	v := s.pull(e.totalBits)
+	*state = e.delta + int(v>>uint(e.valueBits))
+
+	return e.base + int32(v&(1<<uint(e.valueBits)-1)), nil
+}
+
+// decode decodes the payload of a compressed block, appending it to out.
+func (h *lzfseBlockHeader) decode(out, payload []byte) ([]byte, error) {
+	literals, err := h.decodeLiterals(payload[:h.literalPayloadSize])
+
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := newFSEInStream(payload[h.literalPayloadSize:], h.lmdBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		lTable = newFSEValueDecoderTable(lzfseLStates, h.lFreq[:], lzfseLExtraBits[:], lzfseLBaseValue)
+		mTable = newFSEValueDecoderTable(lzfseMStates, h.mFreq[:], lzfseMExtraBits[:], lzfseMBaseValue)
+		dTable = newFSEValueDecoderTable(lzfseDStates, h.dFreq[:], lzfseDExtraBits[:], lzfseDBaseValue)
+
+		lState, mState, dState = int(h.lState), int(h.mState), int(h.dState)
+
+		start = len(out)
+		d     = -1
+	)
+
+	for i := 0; i < h.matches; i++ {
+		if err := in.flush(); err != nil {
+			return nil, err
+		}
+
+		l, err := in.decodeValue(&lState, lTable)
+
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := in.decodeValue(&mState, mTable)
+
+		if err != nil {
+			return nil, err
+		}
+
+		newD, err := in.decodeValue(&dState, dTable)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if newD != 0 {
+			d = int(newD)
+		}
+
+		if int(l) > len(literals) {
+			return nil, lzfseError("literal length overruns literals")
+		}
+
+		out = append(out, literals[:l]...)
+		literals = literals[l:]
+
+		if m > 0 {
+			var ok bool
+
+			if out, ok = copyMatch(out, d, int(m)); !ok {
+				return nil, lzfseError("bad match distance %d", d)
+			}
+		}
+
+		if len(out)-start > h.rawSize {
+			return nil, lzfseError("block overruns its size")
+		}
+	}
+
+	if len(out)-start != h.rawSize {
+		return nil, lzfseError("block decoded to %d bytes, expected %d", len(out)-start, h.rawSize)
+	}
+
+	return out, nil
+}
+
+// decodeLiterals decodes the literals of a block, which are interleaved between four FSE states.
+func (h *lzfseBlockHeader) decodeLiterals(payload []byte) ([]byte, error) {
+	in, err := newFSEInStream(payload, h.literalBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	table := newFSEDecoderTable(lzfseLiteralStates, h.literalFreq[:])
+	states := [4]int{int(h.literalState[0]), int(h.literalState[1]), int(h.literalState[2]), int(h.literalState[3])}
+	literals := make([]byte, 0, h.literals+4)
+
+	for i := 0; i < h.literals; i += 4 {
+		if err := in.flush(); err != nil {
+			return nil, err
+		}
+
+		for j := range states {
+			c, err := in.decode(&states[j], table)
+
+			if err != nil {
+				return nil, err
+			}
+
+			literals = append(literals, c)
+		}
+	}
+
+	return literals[:h.literals], nil
+}
+
+// copyMatch appends length bytes to out, copied from distance bytes back. The copy may overlap itself.
+// It reports false if distance is out of range.
+func copyMatch(out []byte, distance, length int) ([]byte, bool) {
+	if distance <= 0 || distance > len(out) {
+		return out, false
+	}
+
+	from := len(out) - distance
+
+	for i := 0; i < length; i++ {
+		out = append(out, out[from+i])
+	}
+
+	return out, true
+}
@@ -0,0 +1,121 @@
+package ipsw
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+func lzvnError(format string, args ...interface{}) error {
+	return &ImageFormatError{Format: "LZVN", Err: fmt.Errorf(format, args...)}
+}
+
+// DecompressLZVN decompresses a raw LZVN stream, without a bvxn block header, which decompresses to size bytes.
+func DecompressLZVN(data []byte, size int) ([]byte, error) {
+	return decompressLZVN(nil, data, size)
+}
+
+// lzvnOpcodeLength returns the length of the opcode starting with op, not including any literals.
+func lzvnOpcodeLength(op byte) int {
+	switch {
+	case op >= 0xa0 && op <= 0xbf:
+		return 3
+	case op == 0xe0, op == 0xf0:
+		return 2
+	case op > 0xe0:
+		return 1
+	case op&7 == 6:
+		return 1
+	case op&7 == 7:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// decompressLZVN decompresses src, appending size bytes to out. Matches may refer back into out.
+func decompressLZVN(out, src []byte, size int) ([]byte, error) {
+	end := len(out) + size
+	d := 0
+
+	for len(out) < end {
+		if len(src) == 0 {
+			return nil, lzvnError("truncated stream")
+		}
+
+		op := src[0]
+
+		switch {
+		case op == 0x06:
+			return nil, lzvnError("stream ended after %d of %d bytes", size-(end-len(out)), size)
+		case op == 0x0e, op == 0x16:
+			src = src[1:]
+			continue
+		case op >= 0x70 && op <= 0x7f, op >= 0xd0 && op <= 0xdf, op < 0x40 && op&7 == 6:
+			return nil, lzvnError("undefined opcode %#x", op)
+		}
+
+		opLen := lzvnOpcodeLength(op)
+
+		if len(src) < opLen {
+			return nil, lzvnError("truncated opcode")
+		}
+
+		var l, m int
+
+		switch {
+		case op >= 0xa0 && op <= 0xbf:
+			// medium distance
+			extra := int(binary.LittleEndian.Uint16(src[1:]))
+			l = int(op>>3) & 3
+			m = (int(op&7)<<2 | extra&3) + 3
+			d = extra >> 2
+		case op == 0xe0:
+			// large literal
+			l = int(src[1]) + 16
+		case op > 0xe0 && op <= 0xef:
+			// small literal
+			l = int(op & 0xf)
+		case op == 0xf0:
+			// large match, previous distance
+			m = int(src[1]) + 16
+		case op > 0xf0:
+			// small match, previous distance
+			m = int(op & 0xf)
+		default:
+			l = int(op >> 6)
+			m = int(op>>3)&7 + 3
+
+			switch op & 7 {
+			case 6:
+				// previous distance
+			case 7:
+				d = int(binary.LittleEndian.Uint16(src[1:]))
+			default:
+				d = int(op&7)<<8 | int(src[1])
+			}
+		}
+
+		src = src[opLen:]
+
+		if l > len(src) {
+			return nil, lzvnError("truncated literal")
+		}
+
+		if len(out)+l+m > end {
+			return nil, lzvnError("stream overruns its size")
+		}
+
+		out = append(out, src[:l]...)
+		src = src[l:]
+
+		if m > 0 {
+			var ok bool
+
+			if out, ok = copyMatch(out, d, m); !ok {
+				return nil, lzvnError("bad match distance %d", d)
+			}
+		}
+	}
+
+	return out, nil
+}
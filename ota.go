@@ -1,6 +1,7 @@
 package ipsw
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"strconv"
@@ -38,7 +39,20 @@ func (o *OTAFirmware) GetURL() string {
 
 // NewOTAXML generates a new OTA XML struct
 func NewOTAXML(src string) (*OTAXML, error) {
-	resp, err := DefaultClient.Get(src)
+	return defaultClient().NewOTAXML(src)
+}
+
+// NewOTAXMLContext generates a new OTA XML struct, fetching src with ctx.
+func NewOTAXMLContext(ctx context.Context, src string) (*OTAXML, error) {
+	return defaultClient().NewOTAXMLContext(ctx, src)
+}
+
+func (c *Client) NewOTAXML(src string) (*OTAXML, error) {
+	return c.NewOTAXMLContext(context.Background(), src)
+}
+
+func (c *Client) NewOTAXMLContext(ctx context.Context, src string) (*OTAXML, error) {
+	resp, err := c.get(ctx, src)
 
 	if err != nil {
 		return nil, err
@@ -89,10 +103,9 @@ type OTABuildIdentityInfo struct {
 	DeviceClass string `plist:"DeviceClass"`
 }
 
+// OTAZip is an OTA update file. Like IPSW, it is safe for concurrent use.
 type OTAZip struct {
 	*IPSW
-
-	manifest *OTABuildManifest
 }
 
 func NewOTAZip(identifier, build, resource string) *OTAZip {
@@ -105,18 +118,31 @@ func NewOTAZip(identifier, build, resource string) *OTAZip {
 	}
 }
 
-func (z *OTAZip) BuildManifest() (*OTABuildManifest, error) {
-	if z.manifest != nil {
-		return z.manifest, nil
+// NewOTAZipWithSource creates an OTAZip which is read from src rather than a URL.
+func NewOTAZipWithSource(identifier, build string, src Source) *OTAZip {
+	return &OTAZip{
+		IPSW: NewIPSWWithSource(identifier, build, src),
 	}
+}
 
-	var manifest OTABuildManifest
+func (z *OTAZip) BuildManifest() (*OTABuildManifest, error) {
+	return z.BuildManifestContext(context.Background())
+}
+
+func (z *OTAZip) BuildManifestContext(ctx context.Context) (*OTABuildManifest, error) {
+	manifest, err := z.loads.load(ctx, "ota-manifest", func(ctx context.Context) (interface{}, error) {
+		var manifest OTABuildManifest
 
-	err := z.PlistFromZip(OTABuildManifestFilename, &manifest)
+		err := z.PlistFromZipContext(ctx, OTABuildManifestFilename, &manifest)
 
-	z.manifest = &manifest
+		return &manifest, err
+	})
 
-	return &manifest, err
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest.(*OTABuildManifest), nil
 }
 
 func (m *OTABuildManifest) DeviceByIdentifier(identifier Identifier) (*Device, error) {
@@ -137,6 +163,10 @@ func (m *OTABuildManifest) DeviceByIdentifier(identifier Identifier) (*Device, e
 		}
 	}
 
+	if identity == nil {
+		return nil, &IdentifierNotFoundError{Identifier: identifier, In: OTABuildManifestFilename}
+	}
+
 	chipID, err := strconv.ParseInt(identity.ApChipID, 0, 0)
 
 	if err != nil {
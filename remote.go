@@ -1,12 +1,13 @@
 package ipsw
 
 import (
-	"archive/zip"
-	"fmt"
+	"context"
+	"errors"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cj123/ranger"
@@ -27,65 +28,262 @@ type HTTPClient interface {
 	PostForm(string, url.Values) (*http.Response, error)
 }
 
-func bufferedDownload(file *zip.File, writer io.Writer) error {
-	rc, err := file.Open()
+// contextClient is an HTTPClient which makes every request with ctx.
+// ranger has no notion of a context, so this is how cancellation reaches its range reads.
+// Error responses are returned as an HTTPStatusError, which is also kept in lastErr
+// in case ranger does not pass it on intact.
+type contextClient struct {
+	ctx     context.Context
+	client  *Client
+	lastErr error
+}
+
+func (c *contextClient) Do(req *http.Request) (*http.Response, error) {
+	res, err := c.client.do(req.WithContext(c.ctx))
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if res.StatusCode >= http.StatusBadRequest {
+		res.Body.Close()
+
+		c.lastErr = newHTTPStatusError(req.URL.String(), res)
+
+		return nil, c.lastErr
+	}
+
+	return res, nil
+}
+
+func (c *contextClient) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Do(req)
+}
+
+func (c *contextClient) Head(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+
+	if err != nil {
+		return nil, err
 	}
 
-	defer rc.Close()
+	return c.Do(req)
+}
+
+func (c *contextClient) Post(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+
+	return c.Do(req)
+}
+
+func (c *contextClient) PostForm(url string, data url.Values) (*http.Response, error) {
+	return c.Post(url, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
+}
+
+// remoteReaderAt reads from a ranger.Reader, making the underlying range requests with
+// the context of each read. ranger.Reader is not safe for concurrent use, so reads are serialised.
+type remoteReaderAt struct {
+	mu     sync.Mutex
+	client *contextClient
+	reader *ranger.Reader
+}
+
+func newRemoteReaderAt(c *Client, u *url.URL) (*remoteReaderAt, error) {
+	client := &contextClient{ctx: context.Background(), client: c}
+
+	reader, err := ranger.NewReader(
+		&ranger.HTTPRanger{
+			URL:                            u,
+			Client:                         client,
+			DisableAcceptRangesHeaderCheck: true,
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &remoteReaderAt{client: client, reader: reader}, nil
+}
+
+func (r *remoteReaderAt) readAt(ctx context.Context, p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	r.client.ctx, r.client.lastErr = ctx, nil
+	defer func() { r.client.ctx = context.Background() }()
+
+	n, err := r.reader.ReadAt(p, off)
+
+	return n, r.error(err)
+}
+
+func (r *remoteReaderAt) length(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.client.ctx, r.client.lastErr = ctx, nil
+	defer func() { r.client.ctx = context.Background() }()
 
-	_, err = io.Copy(writer, rc)
+	n, err := r.reader.Length()
+
+	return n, r.error(err)
+}
+
+// error prefers the HTTPStatusError behind err, if ranger has hidden it.
+func (r *remoteReaderAt) error(err error) error {
+	var statusErr *HTTPStatusError
+
+	if err != nil && r.client.lastErr != nil && !errors.As(err, &statusErr) {
+		return r.client.lastErr
+	}
 
 	return err
 }
 
+// DownloadFile downloads file from the zip at resource into w.
+// resource is a URL or local path, see NewSource.
 func DownloadFile(resource, file string, w io.Writer) error {
-	u, err := url.Parse(resource)
+	return defaultClient().DownloadFile(resource, file, w)
+}
+
+// DownloadFileContext downloads file from the zip at resource into w.
+// ctx is used for every request made, including retries.
+func DownloadFileContext(ctx context.Context, resource, file string, w io.Writer) error {
+	return defaultClient().DownloadFileContext(ctx, resource, file, w)
+}
+
+// DownloadFileWithOptions downloads file from the zip at resource into w,
+// retrying and logging as set in opts.
+func DownloadFileWithOptions(ctx context.Context, resource, file string, w io.Writer, opts *DownloadOptions) error {
+	return defaultClient().DownloadFileWithOptions(ctx, resource, file, w, opts)
+}
+
+// DownloadFileFromSource downloads file from the zip in src into w.
+func DownloadFileFromSource(ctx context.Context, src Source, file string, w io.Writer, opts *DownloadOptions) error {
+	return defaultClient().DownloadFileFromSource(ctx, src, file, w, opts)
+}
+
+func (c *Client) DownloadFile(resource, file string, w io.Writer) error {
+	return c.DownloadFileContext(context.Background(), resource, file, w)
+}
+
+func (c *Client) DownloadFileContext(ctx context.Context, resource, file string, w io.Writer) error {
+	return c.DownloadFileWithOptions(ctx, resource, file, w, nil)
+}
+
+// DownloadFileWithOptions downloads file from the zip at resource into w.
+// Anything set in opts overrides the client's settings for this call.
+func (c *Client) DownloadFileWithOptions(ctx context.Context, resource, file string, w io.Writer, opts *DownloadOptions) error {
+	src, err := c.NewSource(resource)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeSource(src)
+
+	return c.DownloadFileFromSource(ctx, src, file, w, opts)
+}
+
+func (c *Client) DownloadFileFromSource(ctx context.Context, src Source, file string, w io.Writer, opts *DownloadOptions) error {
+	z, err := openZip(ctx, src, c.options(opts))
 
 	if err != nil {
 		return err
 	}
 
-	var zipReader *zip.Reader
+	return z.extract(ctx, file, w)
+}
+
+// errStalled is returned when a stream goes without data for longer than its client's timeout.
+// It is a timeout, so is retried by a RetryPolicy.
+type errStalled struct{}
+
+func (errStalled) Error() string   { return "ipsw: no data received before timeout" }
+func (errStalled) Timeout() bool   { return true }
+func (errStalled) Temporary() bool { return true }
+
+// stallReader reads a response body, cancelling its request if no data arrives for timeout.
+// A zero timeout never cancels.
+type stallReader struct {
+	rc      io.ReadCloser
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
 
-	for downloadCount := 1; downloadCount <= MaxDownloadTries; downloadCount++ {
-		reader, err := ranger.NewReader(
-			&ranger.HTTPRanger{
-				URL:                            u,
-				Client:                         DefaultClient,
-				DisableAcceptRangesHeaderCheck: true,
-			},
-		)
+	mu      sync.Mutex
+	stalled bool
+}
+
+func newStallReader(cancel context.CancelFunc, timeout time.Duration) *stallReader {
+	s := &stallReader{cancel: cancel, timeout: timeout}
 
-		if err != nil {
-			return err
-		}
+	if timeout > 0 {
+		s.timer = time.AfterFunc(timeout, func() {
+			s.mu.Lock()
+			s.stalled = true
+			s.mu.Unlock()
 
-		readerLen, err := reader.Length()
+			cancel()
+		})
+	}
 
-		if err != nil {
-			return err
-		}
+	return s
+}
 
-		zipReader, err = zip.NewReader(reader, readerLen)
+// err returns errStalled in place of err if the request was cancelled for stalling.
+func (s *stallReader) err(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		if err == zip.ErrFormat && downloadCount != MaxDownloadTries {
-			log.Printf("Caught error, %s, trying again (%d of %d)", err, downloadCount, MaxDownloadTries)
-			continue
-		} else if err != nil {
-			return err
-		} else { // err == nil
-			break
-		}
+	if s.stalled {
+		return errStalled{}
 	}
 
-	for _, f := range zipReader.File {
-		if f.Name == file {
-			return bufferedDownload(f, w)
-		}
+	return err
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.rc.Read(p)
+
+	if s.timer != nil && n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+
+	if err != nil && err != io.EOF {
+		err = s.err(err)
+	}
+
+	return n, err
+}
+
+func (s *stallReader) Close() error {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+
+	s.cancel()
+
+	if s.rc == nil {
+		return nil
 	}
 
-	return fmt.Errorf("pwn: file '%s' not found in resource '%s'", file, resource)
+	return s.rc.Close()
 }
@@ -0,0 +1,241 @@
+package ipsw
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Logger receives structured log messages, as a message followed by alternating keys and values.
+type Logger interface {
+	Log(msg string, keyvals ...interface{})
+}
+
+// LoggerFunc adapts a function to a Logger.
+type LoggerFunc func(msg string, keyvals ...interface{})
+
+func (f LoggerFunc) Log(msg string, keyvals ...interface{}) {
+	f(msg, keyvals...)
+}
+
+// NopLogger discards everything logged to it.
+var NopLogger Logger = LoggerFunc(func(string, ...interface{}) {})
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+// NewStdLogger returns a Logger which writes "msg key=value ..." lines to l.
+// If l is nil, the standard logger of the log package is used.
+func NewStdLogger(l *log.Logger) Logger {
+	return stdLogger{l: l}
+}
+
+func (s stdLogger) Log(msg string, keyvals ...interface{}) {
+	var b strings.Builder
+
+	b.WriteString(msg)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		var val interface{} = "(missing)"
+
+		if i+1 < len(keyvals) {
+			val = keyvals[i+1]
+		}
+
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], val)
+	}
+
+	if s.l == nil {
+		log.Print(b.String())
+	} else {
+		s.l.Print(b.String())
+	}
+}
+
+// RetryPolicy decides which failed requests are retried, and how long to wait between attempts.
+// Delays grow exponentially from BaseDelay up to MaxDelay, unless the server asks for a
+// longer wait with a Retry-After header.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts made, including the first.
+	MaxAttempts int
+
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Jitter is the fraction of each delay which is randomised, from 0 to 1.
+	Jitter float64
+
+	// RetryableErrors are retried if they match an error with errors.Is.
+	RetryableErrors []error
+
+	// RetryableStatuses are the HTTP status codes which are retried.
+	RetryableStatuses []int
+}
+
+// DefaultRetryPolicy returns the policy used when none is given. It makes MaxDownloadTries attempts.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: MaxDownloadTries,
+		BaseDelay:   250 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+		Jitter:      0.5,
+		RetryableErrors: []error{
+			zip.ErrFormat,
+			io.ErrUnexpectedEOF,
+		},
+		RetryableStatuses: []int{
+			http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// Retryable reports whether err should be retried. Network timeouts are always retried.
+func (p *RetryPolicy) Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var statusErr *HTTPStatusError
+
+	if errors.As(err, &statusErr) {
+		for _, status := range p.RetryableStatuses {
+			if statusErr.StatusCode == status {
+				return true
+			}
+		}
+	}
+
+	for _, retryable := range p.RetryableErrors {
+		if errors.Is(err, retryable) {
+			return true
+		}
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Delay returns how long to wait before the attempt after attempt, which failed with err.
+func (p *RetryPolicy) Delay(attempt int, err error) time.Duration {
+	delay := time.Duration(float64(p.BaseDelay) * math.Pow(2, float64(attempt-1)))
+
+	if p.MaxDelay > 0 && (delay > p.MaxDelay || delay < 0) {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		delay = time.Duration(float64(delay) * (1 - jitter*rand.Float64()))
+	}
+
+	var statusErr *HTTPStatusError
+
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+		delay = statusErr.RetryAfter
+	}
+
+	return delay
+}
+
+// Do calls fn until it succeeds, returns an error which is not retryable, or MaxAttempts is reached.
+// fn is given the number of the attempt, starting from 1.
+func (p *RetryPolicy) Do(ctx context.Context, logger Logger, fn func(attempt int) error) error {
+	maxAttempts := p.MaxAttempts
+
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+
+		if permanent, ok := err.(permanentError); ok {
+			return permanent.err
+		}
+
+		if err == nil || attempt >= maxAttempts || !p.Retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := p.Delay(attempt, err)
+
+		logger.Log("retrying after error", "error", err, "attempt", attempt, "max_attempts", maxAttempts, "delay", delay)
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// permanentError is returned to RetryPolicy.Do to stop err from being retried.
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or a date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// DownloadOptions configure how files are downloaded. A nil *DownloadOptions uses
+// DefaultRetryPolicy and logs with the log package.
+type DownloadOptions struct {
+	Retry  *RetryPolicy
+	Logger Logger
+}
+
+func (o *DownloadOptions) retry() *RetryPolicy {
+	if o == nil || o.Retry == nil {
+		return DefaultRetryPolicy()
+	}
+
+	return o.Retry
+}
+
+func (o *DownloadOptions) logger() Logger {
+	if o == nil || o.Logger == nil {
+		return NewStdLogger(nil)
+	}
+
+	return o.Logger
+}
@@ -1,8 +1,14 @@
 package ipsw
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type SHSHJSON map[Identifier]*SHSHDevice
@@ -27,7 +33,20 @@ type SigningStatus struct {
 
 // NewSHSHJSON returns a new instance of SHSHJSON
 func NewSHSHJSON(sourceURL string) (SHSHJSON, error) {
-	resp, err := DefaultClient.Get(sourceURL)
+	return defaultClient().NewSHSHJSON(sourceURL)
+}
+
+// NewSHSHJSONContext returns a new instance of SHSHJSON, fetching sourceURL with ctx.
+func NewSHSHJSONContext(ctx context.Context, sourceURL string) (SHSHJSON, error) {
+	return defaultClient().NewSHSHJSONContext(ctx, sourceURL)
+}
+
+func (c *Client) NewSHSHJSON(sourceURL string) (SHSHJSON, error) {
+	return c.NewSHSHJSONContext(context.Background(), sourceURL)
+}
+
+func (c *Client) NewSHSHJSONContext(ctx context.Context, sourceURL string) (SHSHJSON, error) {
+	resp, err := c.get(ctx, sourceURL)
 
 	if err != nil {
 		return nil, err
@@ -51,3 +70,231 @@ func NewSHSHJSON(sourceURL string) (SHSHJSON, error) {
 
 	return shsh, err
 }
+
+// signingTimeLayouts are the layouts the times of a SigningStatus are given in. They are in UTC.
+var signingTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// parseSigningTime parses a Started or Stopped time, which may also be a unix timestamp.
+// An empty time is returned as the zero time.
+func parseSigningTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0).UTC(), nil
+	}
+
+	for _, layout := range signingTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("ipsw: invalid signing time '%s'", s)
+}
+
+// StartedAt returns the time signing started, or the zero time if it is not known.
+func (f *SigningStatus) StartedAt() (time.Time, error) {
+	return parseSigningTime(f.Started)
+}
+
+// StoppedAt returns the time signing stopped, or the zero time if the build is still signed.
+func (f *SigningStatus) StoppedAt() (time.Time, error) {
+	return parseSigningTime(f.Stopped)
+}
+
+// Window returns how long the build was signed for, or has been signed for up to now if it is still signed.
+func (f *SigningStatus) Window(now time.Time) (time.Duration, error) {
+	started, err := f.StartedAt()
+
+	if err != nil {
+		return 0, err
+	}
+
+	stopped, err := f.StoppedAt()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if started.IsZero() {
+		return 0, fmt.Errorf("ipsw: build %s has no signing start time", f.BuildID)
+	}
+
+	if stopped.IsZero() || f.Signing {
+		stopped = now
+	}
+
+	return stopped.Sub(started), nil
+}
+
+// SignedAt reports whether the build was signed at t. A build with no start time is only signed at t if it is signed now.
+func (f *SigningStatus) SignedAt(t time.Time) (bool, error) {
+	started, err := f.StartedAt()
+
+	if err != nil {
+		return false, err
+	}
+
+	stopped, err := f.StoppedAt()
+
+	if err != nil {
+		return false, err
+	}
+
+	if started.IsZero() {
+		return f.Signing, nil
+	}
+
+	return !t.Before(started) && (f.Signing || stopped.IsZero() || t.Before(stopped)), nil
+}
+
+// Firmware returns the signing status of build, or nil if the device has none.
+func (d *SHSHDevice) Firmware(build string) *SigningStatus {
+	for _, f := range d.Firmwares {
+		if f.BuildID == build {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// SignedBuilds returns the builds which are currently signed for identifier.
+func (s SHSHJSON) SignedBuilds(identifier Identifier) ([]*SigningStatus, error) {
+	device, ok := s[identifier]
+
+	if !ok {
+		return nil, &IdentifierNotFoundError{Identifier: identifier, In: "SHSHJSON"}
+	}
+
+	var signed []*SigningStatus
+
+	for _, f := range device.Firmwares {
+		if f.Signing {
+			signed = append(signed, f)
+		}
+	}
+
+	return signed, nil
+}
+
+// SignedAt returns the builds which were signed for identifier at t.
+func (s SHSHJSON) SignedAt(identifier Identifier, t time.Time) ([]*SigningStatus, error) {
+	device, ok := s[identifier]
+
+	if !ok {
+		return nil, &IdentifierNotFoundError{Identifier: identifier, In: "SHSHJSON"}
+	}
+
+	var signed []*SigningStatus
+
+	for _, f := range device.Firmwares {
+		ok, err := f.SignedAt(t)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			signed = append(signed, f)
+		}
+	}
+
+	return signed, nil
+}
+
+// SigningEventType is whether a build started or stopped being signed.
+type SigningEventType int
+
+const (
+	BuildSigned SigningEventType = iota
+	BuildUnsigned
+)
+
+func (t SigningEventType) String() string {
+	switch t {
+	case BuildSigned:
+		return "signed"
+	case BuildUnsigned:
+		return "unsigned"
+	default:
+		return fmt.Sprintf("SigningEventType(%d)", int(t))
+	}
+}
+
+// SigningEvent is a change to the signing status of a build for a device between two SHSHJSON snapshots.
+type SigningEvent struct {
+	Type       SigningEventType
+	Identifier Identifier
+
+	// Status is the status of the build in the newer snapshot, or in the older one if the build is no longer listed.
+	Status *SigningStatus
+}
+
+// DiffSHSHJSON returns the builds which started or stopped being signed between the snapshots before and after,
+// sorted by identifier and build. Signed builds which are no longer listed for a device in after are unsigned,
+// but devices which are missing from after are left out, as a partial snapshot says nothing about them.
+func DiffSHSHJSON(before, after SHSHJSON) []*SigningEvent {
+	var events []*SigningEvent
+
+	signed := func(s SHSHJSON, identifier Identifier, build string) bool {
+		device, ok := s[identifier]
+
+		if !ok {
+			return false
+		}
+
+		f := device.Firmware(build)
+
+		return f != nil && f.Signing
+	}
+
+	for identifier, device := range after {
+		for _, f := range device.Firmwares {
+			if f.Signing && !signed(before, identifier, f.BuildID) {
+				events = append(events, &SigningEvent{Type: BuildSigned, Identifier: identifier, Status: f})
+			}
+		}
+	}
+
+	for identifier, device := range before {
+		current, ok := after[identifier]
+
+		if !ok {
+			continue
+		}
+
+		for _, f := range device.Firmwares {
+			if !f.Signing || signed(after, identifier, f.BuildID) {
+				continue
+			}
+
+			status := f
+
+			if c := current.Firmware(f.BuildID); c != nil {
+				status = c
+			}
+
+			events = append(events, &SigningEvent{Type: BuildUnsigned, Identifier: identifier, Status: status})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Identifier != events[j].Identifier {
+			return events[i].Identifier < events[j].Identifier
+		}
+
+		return events[i].Status.BuildID < events[j].Status.BuildID
+	})
+
+	return events
+}
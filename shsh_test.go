@@ -0,0 +1,159 @@
+package ipsw
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testSHSHJSON(devices map[Identifier][]*SigningStatus) SHSHJSON {
+	shsh := make(SHSHJSON)
+
+	for identifier, firmwares := range devices {
+		shsh[identifier] = &SHSHDevice{Identifier: string(identifier), Firmwares: firmwares}
+	}
+
+	return shsh
+}
+
+func TestSigningStatusTimes(t *testing.T) {
+	f := &SigningStatus{BuildID: "17A577", Started: "2019-09-19 17:00:00", Stopped: "1570208400"}
+
+	started, err := f.StartedAt()
+
+	if err != nil || !started.Equal(time.Date(2019, 9, 19, 17, 0, 0, 0, time.UTC)) {
+		t.Fatalf("started at %v, %v", started, err)
+	}
+
+	stopped, err := f.StoppedAt()
+
+	if err != nil || !stopped.Equal(time.Date(2019, 10, 4, 17, 0, 0, 0, time.UTC)) {
+		t.Fatalf("stopped at %v, %v", stopped, err)
+	}
+
+	if window, err := f.Window(time.Now()); err != nil || window != 15*24*time.Hour {
+		t.Fatalf("signed for %v, %v", window, err)
+	}
+
+	for _, c := range []struct {
+		at     time.Time
+		signed bool
+	}{
+		{started.Add(-time.Second), false},
+		{started, true},
+		{stopped.Add(-time.Second), true},
+		{stopped, false},
+	} {
+		if signed, err := f.SignedAt(c.at); err != nil || signed != c.signed {
+			t.Errorf("signed at %v is %t, %v, expected %t", c.at, signed, err, c.signed)
+		}
+	}
+
+	// a build which is still signed is signed up to now, whatever its stop time
+	current := &SigningStatus{Signing: true, Started: "2020-01-01T00:00:00Z"}
+	now := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	if window, err := current.Window(now); err != nil || window != 24*time.Hour {
+		t.Fatalf("current build signed for %v, %v", window, err)
+	}
+
+	if stopped, err := current.StoppedAt(); err != nil || !stopped.IsZero() {
+		t.Fatalf("current build stopped at %v, %v", stopped, err)
+	}
+
+	if _, err := (&SigningStatus{Signing: true}).Window(now); err == nil {
+		t.Fatal("expected an error for a build with no start time")
+	}
+
+	if _, err := (&SigningStatus{Started: "yesterday"}).StartedAt(); err == nil {
+		t.Fatal("expected an error for an invalid time")
+	}
+
+	if signed, err := (&SigningStatus{Signing: true}).SignedAt(now); err != nil || !signed {
+		t.Fatalf("build with no start time signed at %v is %t, %v", now, signed, err)
+	}
+}
+
+func TestSHSHJSONSignedQueries(t *testing.T) {
+	shsh := testSHSHJSON(map[Identifier][]*SigningStatus{
+		"iPhone12,1": {
+			{BuildID: "17A577", Started: "2019-09-19", Stopped: "2019-10-04"},
+			{BuildID: "17A860", Started: "2019-09-26", Stopped: "2019-10-28"},
+			{BuildID: "17B84", Signing: true, Started: "2019-10-28"},
+		},
+	})
+
+	signed, err := shsh.SignedBuilds("iPhone12,1")
+
+	if err != nil || len(signed) != 1 || signed[0].BuildID != "17B84" {
+		t.Fatalf("signed builds are %v, %v", signed, err)
+	}
+
+	signed, err = shsh.SignedAt("iPhone12,1", time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC))
+
+	if err != nil || len(signed) != 2 || signed[0].BuildID != "17A577" || signed[1].BuildID != "17A860" {
+		t.Fatalf("builds signed on 1st October are %v, %v", signed, err)
+	}
+
+	if _, err := shsh.SignedBuilds("iPad1,1"); !errors.Is(err, ErrIdentifierNotFound) {
+		t.Fatalf("expected ErrIdentifierNotFound, got %v", err)
+	}
+
+	if _, err := shsh.SignedAt("iPad1,1", time.Now()); !errors.Is(err, ErrIdentifierNotFound) {
+		t.Fatalf("expected ErrIdentifierNotFound, got %v", err)
+	}
+}
+
+func TestDiffSHSHJSON(t *testing.T) {
+	before := testSHSHJSON(map[Identifier][]*SigningStatus{
+		"iPhone12,1": {
+			{BuildID: "17A577", Signing: true},
+			{BuildID: "17A860", Signing: true},
+			{BuildID: "17A878", Signing: true},
+		},
+		"iPad8,1": {
+			{BuildID: "17A577", Signing: true},
+		},
+	})
+
+	after := testSHSHJSON(map[Identifier][]*SigningStatus{
+		"iPhone12,1": {
+			// no longer signed
+			{BuildID: "17A577", Signing: false, Stopped: "2019-10-04"},
+			// unchanged
+			{BuildID: "17A860", Signing: true},
+			// 17A878 is no longer listed, so is no longer signed
+			{BuildID: "17B84", Signing: true},
+		},
+		// iPad8,1 is missing, which says nothing about it
+		"iPhone12,3": {
+			{BuildID: "17B84", Signing: true},
+		},
+	})
+
+	var got []string
+
+	for _, event := range DiffSHSHJSON(before, after) {
+		got = append(got, fmt.Sprintf("%s %s %s %s", event.Type, event.Identifier, event.Status.BuildID, event.Status.Stopped))
+	}
+
+	want := []string{
+		"unsigned iPhone12,1 17A577 2019-10-04",
+		"unsigned iPhone12,1 17A878 ",
+		"signed iPhone12,1 17B84 ",
+		"signed iPhone12,3 17B84 ",
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("diff is %q, expected %q", got, want)
+	}
+
+	if events := DiffSHSHJSON(after, after); len(events) != 0 {
+		t.Fatalf("expected no changes between identical snapshots, got %d", len(events))
+	}
+
+	if events := DiffSHSHJSON(nil, after); len(events) != 3 {
+		t.Fatalf("expected every signed build to be new, got %d events", len(events))
+	}
+}
@@ -0,0 +1,456 @@
+package ipsw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Source is somewhere a firmware archive can be read from, such as a URL or a local file.
+// A Source must be safe for concurrent use.
+type Source interface {
+	// Size returns the size of the archive in bytes.
+	Size(ctx context.Context) (int64, error)
+
+	// ReadAt reads len(p) bytes from off, as io.ReaderAt.
+	ReadAt(ctx context.Context, p []byte, off int64) (int, error)
+
+	// Range returns a reader over length bytes from off. Range is used for
+	// large sequential reads, and may be called from multiple goroutines at once.
+	Range(ctx context.Context, off, length int64) (io.ReadCloser, error)
+}
+
+// resettableSource is a Source which caches data, and can discard it before a retry.
+type resettableSource interface {
+	Source
+
+	reset()
+}
+
+// headerSource is a Source which can describe itself with HTTP headers.
+type headerSource interface {
+	Source
+
+	headers(ctx context.Context) (http.Header, error)
+}
+
+// NewSource returns a Source for resource. http:// and https:// URLs are read remotely
+// with range requests, file:// URLs and anything without a scheme are read from disk.
+func NewSource(resource string) (Source, error) {
+	return defaultClient().NewSource(resource)
+}
+
+// NewSource returns a Source for resource, as NewSource. Remote sources are read with the client.
+func (c *Client) NewSource(resource string) (Source, error) {
+	u, err := url.Parse(resource)
+
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// not a URL, or a windows path, e.g. C:\
+		return NewFileSource(resource), nil
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return c.newHTTPSource(u), nil
+	case "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("ipsw: file url '%s' refers to a remote host", resource)
+		}
+
+		return NewFileSource(filepath.FromSlash(u.Path)), nil
+	default:
+		return nil, fmt.Errorf("ipsw: unsupported resource '%s'", resource)
+	}
+}
+
+// closeSource closes src if it holds resources.
+func closeSource(src Source) error {
+	if c, ok := src.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// httpSource reads a remote file with HTTP range requests.
+type httpSource struct {
+	client *Client
+	url    *url.URL
+
+	mu     sync.Mutex
+	reader *remoteReaderAt
+}
+
+// NewHTTPSource returns a Source which reads the file at u with HTTP range requests.
+func NewHTTPSource(u string) (Source, error) {
+	return defaultClient().NewHTTPSource(u)
+}
+
+// NewHTTPSource returns a Source which reads the file at u with range requests made by the client.
+func (c *Client) NewHTTPSource(u string) (Source, error) {
+	parsed, err := url.Parse(u)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.newHTTPSource(parsed), nil
+}
+
+func (c *Client) newHTTPSource(u *url.URL) Source {
+	src := &httpSource{client: c, url: u}
+
+	if c.Cache != nil {
+		return newCachedSource(src, c.Cache)
+	}
+
+	return src
+}
+
+func (h *httpSource) remote() (*remoteReaderAt, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.reader != nil {
+		return h.reader, nil
+	}
+
+	reader, err := newRemoteReaderAt(h.client, h.url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	h.reader = reader
+
+	return reader, nil
+}
+
+func (h *httpSource) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.reader = nil
+}
+
+func (h *httpSource) Size(ctx context.Context) (int64, error) {
+	r, err := h.remote()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return r.length(ctx)
+}
+
+func (h *httpSource) ReadAt(ctx context.Context, p []byte, off int64) (int, error) {
+	r, err := h.remote()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return r.readAt(ctx, p, off)
+}
+
+func (h *httpSource) Range(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+	return h.client.fetchRange(ctx, h.url.String(), off, off+length)
+}
+
+func (h *httpSource) headers(ctx context.Context) (http.Header, error) {
+	res, err := h.client.get(ctx, h.url.String())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	return res.Header, nil
+}
+
+func (h *httpSource) String() string {
+	return h.url.String()
+}
+
+// readerAtSource reads from an io.ReaderAt.
+type readerAtSource struct {
+	r    io.ReaderAt
+	size int64
+}
+
+// NewReaderAtSource returns a Source which reads size bytes from r.
+// r must be safe for concurrent use, as an *os.File or *bytes.Reader is.
+func NewReaderAtSource(r io.ReaderAt, size int64) Source {
+	return &readerAtSource{r: r, size: size}
+}
+
+func (s *readerAtSource) Size(ctx context.Context) (int64, error) {
+	return s.size, ctx.Err()
+}
+
+func (s *readerAtSource) ReadAt(ctx context.Context, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return s.r.ReadAt(p, off)
+}
+
+func (s *readerAtSource) Range(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(io.NewSectionReader(s.r, off, length)), nil
+}
+
+// FileSource reads a file on disk. The file is opened on first use, and stays
+// open until Close is called.
+type FileSource struct {
+	Path string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSource returns a Source which reads the file at path.
+func NewFileSource(path string) *FileSource {
+	return &FileSource{Path: path}
+}
+
+func (f *FileSource) open() (*os.File, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		return f.file, f.size, nil
+	}
+
+	file, err := os.Open(f.Path)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	if info.IsDir() {
+		file.Close()
+		return nil, 0, errors.New("ipsw: " + f.Path + " is a directory")
+	}
+
+	f.file, f.size = file, info.Size()
+
+	return f.file, f.size, nil
+}
+
+func (f *FileSource) Size(ctx context.Context) (int64, error) {
+	_, size, err := f.open()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return size, ctx.Err()
+}
+
+func (f *FileSource) ReadAt(ctx context.Context, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	file, _, err := f.open()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return file.ReadAt(p, off)
+}
+
+func (f *FileSource) Range(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	file, _, err := f.open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(io.NewSectionReader(file, off, length)), nil
+}
+
+// headers returns the Content-Length and Last-Modified headers a file server would give the file.
+func (f *FileSource) headers(ctx context.Context) (http.Header, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(f.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	h := make(http.Header)
+	h.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	h.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+
+	return h, nil
+}
+
+// Close closes the underlying file, if it has been opened.
+func (f *FileSource) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+func (f *FileSource) String() string {
+	return f.Path
+}
+
+// RangeChunkSize is the most bytes fetched by a single request of a large sequential read, such as
+// Extract, so that no request outlives the timeout of its client, e.g. the 30 seconds of DefaultClient.
+var RangeChunkSize int64 = 8 << 20
+
+// rangeReader reads length bytes from off in src, with a Range call for every RangeChunkSize bytes.
+// A call which fails part way is resumed from where it stopped, as the retry policy allows.
+type rangeReader struct {
+	ctx      context.Context
+	src      Source
+	opts     *DownloadOptions
+	off, end int64
+
+	body     io.ReadCloser
+	bodyEnd  int64
+	failures int
+}
+
+func newRangeReader(ctx context.Context, src Source, off, length int64, opts *DownloadOptions) *rangeReader {
+	return &rangeReader{ctx: ctx, src: src, opts: opts, off: off, end: off + length}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	retry := r.opts.retry()
+
+	for r.off < r.end {
+		n, err := r.read(p)
+
+		if err == nil {
+			if n == 0 {
+				continue
+			}
+
+			r.failures = 0
+
+			return n, nil
+		}
+
+		r.failures++
+
+		if r.failures >= retry.MaxAttempts || !retry.Retryable(err) || r.ctx.Err() != nil {
+			return n, err
+		}
+
+		delay := retry.Delay(r.failures, err)
+
+		r.opts.logger().Log("resuming range after error", "error", err, "offset", r.off, "attempt", r.failures, "delay", delay)
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-r.ctx.Done():
+			timer.Stop()
+			return n, err
+		case <-timer.C:
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	return 0, io.EOF
+}
+
+// read reads from the current request, starting a new one if there is none. The request is
+// dropped once it has been read in full, or fails.
+func (r *rangeReader) read(p []byte) (int, error) {
+	if r.body == nil {
+		length := r.end - r.off
+
+		if length > RangeChunkSize && RangeChunkSize > 0 {
+			length = RangeChunkSize
+		}
+
+		body, err := r.src.Range(r.ctx, r.off, length)
+
+		if err != nil {
+			return 0, err
+		}
+
+		r.body, r.bodyEnd = body, r.off+length
+	}
+
+	if remaining := r.bodyEnd - r.off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := r.body.Read(p)
+	r.off += int64(n)
+
+	if err == io.EOF && r.off < r.bodyEnd {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil || r.off >= r.bodyEnd {
+		r.body.Close()
+		r.body = nil
+	}
+
+	return n, err
+}
+
+func (r *rangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+
+	return err
+}
@@ -0,0 +1,499 @@
+package ipsw
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"howett.net/plist"
+)
+
+const (
+	// DefaultTSSURL is Apple's TSS server.
+	DefaultTSSURL = "https://gs.apple.com/TSS/controller?action=2"
+
+	// TSSStatusOK and TSSStatusNotSigned are the statuses of TSS responses for a ticket, and for a build
+	// which is not being signed for the device.
+	TSSStatusOK        = 0
+	TSSStatusNotSigned = 94
+
+	tssUserAgent        = "InetURL/1.0"
+	tssContentType      = `text/xml; charset="utf-8"`
+	tssTicketKey        = "REQUEST_STRING="
+	tssHostPlatformInfo = "mac"
+	tssVersionInfo      = "libauthinstall-850.0.2"
+
+	// sepNonceSize is the size of the SepNonce sent when the device's is not known.
+	sepNonceSize = 20
+)
+
+// tssCoprocessorPrefixes are the components which are personalised by their own TSS requests, not the AP's.
+var tssCoprocessorPrefixes = []string{
+	"BasebandFirmware",
+	"SE,",
+	"Savage,",
+	"Yonkers,",
+	"Rap,",
+	"eUICC,",
+	"Baobab,",
+	"Veridian,",
+	"Timer,",
+	"Rose,",
+	"BMU,",
+}
+
+// TSSDevice are the parameters of a device which a TSS request is personalised for.
+// The zero value of the modes is a production fused, secure device.
+type TSSDevice struct {
+	ECID uint64
+
+	// ApNonce is the nonce of the device. If it is empty, it is computed from Generator, or if there is
+	// no Generator a random nonce is used, which is enough to check signing status.
+	ApNonce   []byte
+	Generator uint64
+
+	// SepNonce is the nonce of the SEP, which is 20 zero bytes if empty.
+	SepNonce []byte
+
+	// BasebandSerialNumber is the BbSNUM of the device. The baseband is only personalised if it is set.
+	BasebandSerialNumber []byte
+	BasebandGoldCertID   uint64
+	BasebandNonce        []byte
+
+	DevelopmentMode bool
+	InsecureMode    bool
+	InRomDFU        bool
+}
+
+// TSSRequest is a personalisation request for Apple's TSS server.
+type TSSRequest map[string]interface{}
+
+// Bytes returns the request as an XML plist, as it is sent.
+func (r TSSRequest) Bytes() ([]byte, error) {
+	return plist.MarshalIndent(map[string]interface{}(r), plist.XMLFormat, "\t")
+}
+
+// GeneratorApNonce returns the ApNonce a device with chip cpid derives from generator. Devices from the A12 on hash
+// the generator with SHA-384, truncated to 32 bytes, older devices with SHA-1.
+func GeneratorApNonce(generator uint64, cpid int) []byte {
+	var b [8]byte
+
+	binary.LittleEndian.PutUint64(b[:], generator)
+
+	if cpid >= 0x8020 {
+		sum := sha512.Sum384(b[:])
+		return sum[:32]
+	}
+
+	sum := sha1.Sum(b[:])
+
+	return sum[:]
+}
+
+// isIMG3Chip reports whether a chip uses IMG3 images and APTickets, as devices before the A7 do.
+func isIMG3Chip(cpid uint64) bool {
+	return cpid >= 0x8720 && cpid < 0x8960
+}
+
+func parseIdentityUint(name, value string) (uint64, error) {
+	n, err := strconv.ParseUint(value, 0, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("ipsw: invalid %s '%s' in build identity", name, value)
+	}
+
+	return n, nil
+}
+
+// NewTSSRequest builds a request for the personalisation of identity for device, with every component of the
+// identity and its RestoreRequestRules applied.
+func NewTSSRequest(identity *BuildIdentity, device *TSSDevice) (TSSRequest, error) {
+	chipID, err := parseIdentityUint("ApChipID", identity.ApChipID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	boardID, err := parseIdentityUint("ApBoardID", identity.ApBoardID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	uuid, err := newUUID()
+
+	if err != nil {
+		return nil, err
+	}
+
+	img4 := !isIMG3Chip(chipID)
+
+	request := TSSRequest{
+		"@HostPlatformInfo": tssHostPlatformInfo,
+		"@VersionInfo":      tssVersionInfo,
+		"@UUID":             uuid,
+		"ApECID":            device.ECID,
+		"ApChipID":          chipID,
+		"ApBoardID":         boardID,
+		"ApProductionMode":  !device.DevelopmentMode,
+		"ApSecurityMode":    !device.InsecureMode,
+	}
+
+	if identity.ApSecurityDomain != "" {
+		domain, err := parseIdentityUint("ApSecurityDomain", identity.ApSecurityDomain)
+
+		if err != nil {
+			return nil, err
+		}
+
+		request["ApSecurityDomain"] = domain
+	}
+
+	if identity.UniqueBuildID != nil {
+		request["UniqueBuildID"] = identity.UniqueBuildID
+	}
+
+	for key, value := range identity.Unknown {
+		if strings.HasPrefix(key, "Ap,") {
+			request[key] = value
+		}
+	}
+
+	nonce := device.ApNonce
+
+	if len(nonce) == 0 && device.Generator != 0 {
+		nonce = GeneratorApNonce(device.Generator, int(chipID))
+	} else if len(nonce) == 0 {
+		size := 20
+
+		if chipID >= 0x8020 {
+			size = 32
+		}
+
+		nonce = make([]byte, size)
+
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+	}
+
+	request["ApNonce"] = nonce
+
+	if img4 {
+		sepNonce := device.SepNonce
+
+		if len(sepNonce) == 0 {
+			sepNonce = make([]byte, sepNonceSize)
+		}
+
+		request["@ApImg4Ticket"] = true
+		request["SepNonce"] = sepNonce
+	} else {
+		request["@APTicket"] = true
+	}
+
+	parameters := map[string]bool{
+		"ApProductionMode": !device.DevelopmentMode,
+		"ApSecurityMode":   !device.InsecureMode,
+		"ApSupportsImg4":   img4,
+		"ApInRomDFU":       device.InRomDFU,
+	}
+
+	for name, component := range identity.Manifest {
+		if isCoprocessorComponent(name) {
+			continue
+		}
+
+		request[name] = component.tssEntry(parameters)
+	}
+
+	if len(device.BasebandSerialNumber) > 0 {
+		if err := request.addBaseband(identity, device); err != nil {
+			return nil, err
+		}
+	}
+
+	return request, nil
+}
+
+func isCoprocessorComponent(name string) bool {
+	for _, prefix := range tssCoprocessorPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tssEntry returns the component as it is sent in a TSS request, without its Info and with its
+// RestoreRequestRules applied for the device parameters.
+func (m *Manifest) tssEntry(parameters map[string]bool) map[string]interface{} {
+	entry := make(map[string]interface{}, len(m.Unknown)+4)
+
+	for key, value := range m.Unknown {
+		entry[key] = value
+	}
+
+	if m.Digest != nil {
+		entry["Digest"] = m.Digest
+	} else if m.Trusted {
+		// trusted components must have a digest, even if it is empty.
+		entry["Digest"] = []byte{}
+	}
+
+	if m.PartialDigest != nil {
+		entry["PartialDigest"] = m.PartialDigest
+	}
+
+	if m.BuildString != "" {
+		entry["BuildString"] = m.BuildString
+	}
+
+	entry["Trusted"] = m.Trusted
+
+	if m.EPRO {
+		entry["EPRO"] = true
+	}
+
+	if m.ESEC {
+		entry["ESEC"] = true
+	}
+
+	for _, rule := range m.Info.RestoreRequestRules {
+		if !rule.Holds(parameters) {
+			continue
+		}
+
+		for action, value := range rule.Actions {
+			entry[action] = value
+		}
+	}
+
+	return entry
+}
+
+// restoreRequestConditions maps the conditions of RestoreRequestRules to the device parameter they test.
+var restoreRequestConditions = map[string]string{
+	"ApRawProductionMode":     "ApProductionMode",
+	"ApCurrentProductionMode": "ApProductionMode",
+	"ApRawSecurityMode":       "ApSecurityMode",
+	"ApRequiresImage4":        "ApSupportsImg4",
+	"ApInRomDFU":              "ApInRomDFU",
+}
+
+// Holds reports whether every condition of the rule is met by the device parameters. Conditions which
+// are unknown or have no parameter are not met.
+func (r *RestoreRequestRule) Holds(parameters map[string]bool) bool {
+	for condition, want := range r.Conditions {
+		parameter, ok := restoreRequestConditions[condition]
+
+		if !ok {
+			return false
+		}
+
+		value, ok := parameters[parameter]
+
+		if b, isBool := want.(bool); !ok || !isBool || value != b {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addBaseband adds the baseband keys and firmware of identity to the request.
+func (r TSSRequest) addBaseband(identity *BuildIdentity, device *TSSDevice) error {
+	baseband, ok := identity.Manifest["BasebandFirmware"]
+
+	if !ok {
+		return &ComponentNotFoundError{Component: "BasebandFirmware"}
+	}
+
+	chipID, err := parseIdentityUint("BbChipID", identity.BbChipID)
+
+	if err != nil {
+		return err
+	}
+
+	r["@BBTicket"] = true
+	r["BbChipID"] = chipID
+	r["BbGoldCertId"] = device.BasebandGoldCertID
+	r["BbSNUM"] = device.BasebandSerialNumber
+
+	if device.BasebandNonce != nil {
+		r["BbNonce"] = device.BasebandNonce
+	}
+
+	hashes := map[string][]byte{
+		"BbProvisioningManifestKeyHash":      identity.BbProvisioningManifestKeyHash,
+		"BbActivationManifestKeyHash":        identity.BbActivationManifestKeyHash,
+		"BbCalibrationManifestKeyHash":       identity.BbCalibrationManifestKeyHash,
+		"BbFactoryActivationManifestKeyHash": identity.BbFactoryActivationManifestKeyHash,
+		"BbFDRSecurityKeyHash":               identity.BbFDRSecurityKeyHash,
+		"BbSkeyId":                           identity.BbSkeyId,
+	}
+
+	for key, hash := range hashes {
+		if hash != nil {
+			r[key] = hash
+		}
+	}
+
+	entry := make(map[string]interface{}, len(baseband.Unknown)+1)
+
+	for key, value := range baseband.Unknown {
+		entry[key] = value
+	}
+
+	if baseband.Digest != nil {
+		entry["Digest"] = baseband.Digest
+	}
+
+	r["BasebandFirmware"] = entry
+
+	return nil
+}
+
+// newUUID returns a random version 4 UUID, in upper case as the TSS client sends it.
+func newUUID() (string, error) {
+	var b [16]byte
+
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// RequestTicket sends req to DefaultTSSURL, returning the ticket it is signed with as a blob.
+// A refusal is returned as a TSSError, which is ErrNotSigned if the build is not being signed.
+func RequestTicket(req TSSRequest) (*SHSHBlob, error) {
+	return defaultClient().RequestTicket(req)
+}
+
+// RequestTicketContext is RequestTicket with ctx.
+func RequestTicketContext(ctx context.Context, req TSSRequest) (*SHSHBlob, error) {
+	return defaultClient().RequestTicketContext(ctx, req)
+}
+
+func (c *Client) RequestTicket(req TSSRequest) (*SHSHBlob, error) {
+	return c.RequestTicketContext(context.Background(), req)
+}
+
+func (c *Client) RequestTicketContext(ctx context.Context, req TSSRequest) (*SHSHBlob, error) {
+	body, err := req.Bytes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	opts := c.options(nil)
+
+	var blob *SHSHBlob
+
+	err = opts.retry().Do(ctx, opts.logger(), func(attempt int) error {
+		response, err := c.postTSS(ctx, body)
+
+		if err != nil {
+			return err
+		}
+
+		blob, err = parseTSSResponse(response)
+
+		if err != nil {
+			return permanentError{err}
+		}
+
+		return nil
+	})
+
+	return blob, err
+}
+
+func (c *Client) postTSS(ctx context.Context, body []byte) ([]byte, error) {
+	url := c.tssURL()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("Content-Type", tssContentType)
+	httpReq.Header.Set("Cache-Control", "no-cache")
+	httpReq.Header.Set("User-Agent", tssUserAgent)
+
+	res, err := c.do(httpReq)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(url, res); err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+}
+
+// parseTSSResponse parses a response of the form STATUS=0&MESSAGE=SUCCESS&REQUEST_STRING=<plist>.
+// The ticket plist is not escaped, so everything after REQUEST_STRING= is taken as it is.
+func parseTSSResponse(response []byte) (*SHSHBlob, error) {
+	head, ticket := string(response), ""
+
+	if i := strings.Index(head, tssTicketKey); i >= 0 {
+		head, ticket = head[:i], head[i+len(tssTicketKey):]
+	}
+
+	status, message := -1, ""
+
+	for _, field := range strings.Split(head, "&") {
+		kv := strings.SplitN(field, "=", 2)
+
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "STATUS":
+			n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+
+			if err != nil {
+				return nil, fmt.Errorf("ipsw: invalid tss status '%s'", kv[1])
+			}
+
+			status = n
+		case "MESSAGE":
+			message = kv[1]
+		}
+	}
+
+	if status == -1 {
+		return nil, errors.New("ipsw: tss response has no status")
+	}
+
+	if status != TSSStatusOK {
+		return nil, &TSSError{Status: status, Message: message}
+	}
+
+	if ticket == "" {
+		return nil, errors.New("ipsw: tss response has no ticket")
+	}
+
+	return ParseSHSHBlob([]byte(ticket))
+}
@@ -0,0 +1,195 @@
+package ipsw
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testTSSIdentity(chipID, boardID string) *BuildIdentity {
+	return &BuildIdentity{
+		ApChipID:         chipID,
+		ApBoardID:        boardID,
+		ApSecurityDomain: "0x01",
+		UniqueBuildID:    []byte{0xde, 0xad, 0xbe, 0xef},
+		Info:             BuildIdentityInfo{DeviceClass: "n104ap", RestoreBehavior: "Erase"},
+		Manifest: BuildIdentityManifest{
+			"KernelCache": {
+				Digest:  []byte{0x01, 0x02, 0x03},
+				Trusted: true,
+				Info:    ManifestInfo{Path: "kernelcache.release.n104", Personalize: true},
+			},
+			"iBEC": {
+				Digest:  []byte{0x04, 0x05, 0x06},
+				Trusted: true,
+				Info:    ManifestInfo{Path: "Firmware/dfu/iBEC.n104.RELEASE.im4p", Personalize: true},
+			},
+		},
+	}
+}
+
+func testTSSClient(server *TSSServer) (*Client, func()) {
+	s := httptest.NewServer(server)
+
+	return &Client{TSSURL: s.URL, HTTPClient: http.DefaultClient}, s.Close
+}
+
+func TestRequestTicket(t *testing.T) {
+	identity := testTSSIdentity("0x8030", "0x04")
+
+	client, done := testTSSClient(NewTSSServer(identity))
+	defer done()
+
+	device := &TSSDevice{ECID: 0x1234, Generator: 0x1111111111111111}
+
+	req, err := NewTSSRequest(identity, device)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := client.RequestTicketContext(context.Background(), req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := blob.IM4M()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.ECID != device.ECID || m.ChipID != 0x8030 || m.BoardID != 0x04 {
+		t.Errorf("ticket is for ECID %#x, CPID %#x, BDID %#x", m.ECID, m.ChipID, m.BoardID)
+	}
+
+	if nonce := GeneratorApNonce(device.Generator, 0x8030); string(m.ApNonce) != string(nonce) {
+		t.Errorf("ticket has ApNonce %x, expected %x", m.ApNonce, nonce)
+	}
+
+	v, err := blob.Verify(&BuildManifest{BuildIdentities: []BuildIdentity{*identity}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.Valid || v.ECID != device.ECID || len(v.Matched) != 2 {
+		t.Errorf("ticket did not verify: %+v", v)
+	}
+
+	other := testTSSIdentity("0x8030", "0x06")
+
+	if v, err := blob.Verify(&BuildManifest{BuildIdentities: []BuildIdentity{*other}}); err != nil || v.Valid || v.BoardMatches {
+		t.Errorf("ticket verified for another board: %+v, %v", v, err)
+	}
+}
+
+func TestRequestTicketNotSigned(t *testing.T) {
+	identity := testTSSIdentity("0x8030", "0x04")
+	server := NewTSSServer()
+
+	client, done := testTSSClient(server)
+	defer done()
+
+	req, err := NewTSSRequest(identity, &TSSDevice{ECID: 0x1234, Generator: 0x1111111111111111})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.RequestTicketContext(context.Background(), req)
+
+	var tssErr *TSSError
+
+	if !errors.Is(err, ErrNotSigned) || !errors.Is(err, ErrTSSRefused) || !errors.As(err, &tssErr) {
+		t.Fatalf("expected a TSSError for an unsigned build, got %v", err)
+	}
+
+	if tssErr.Status != TSSStatusNotSigned {
+		t.Errorf("expected status %d, got %d", TSSStatusNotSigned, tssErr.Status)
+	}
+
+	server.Sign(identity)
+
+	if _, err := client.RequestTicketContext(context.Background(), req); err != nil {
+		t.Fatalf("signed build was refused: %v", err)
+	}
+
+	server.Unsign(identity)
+
+	if _, err := client.RequestTicketContext(context.Background(), req); !errors.Is(err, ErrNotSigned) {
+		t.Fatalf("expected ErrNotSigned once unsigned, got %v", err)
+	}
+}
+
+func TestRequestTicketUserAgent(t *testing.T) {
+	identity := testTSSIdentity("0x8030", "0x04")
+	server := NewTSSServer(identity)
+
+	var agents []string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.Header.Get("User-Agent"))
+		server.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	client := &Client{TSSURL: s.URL, HTTPClient: http.DefaultClient, UserAgent: "go-ipsw-test"}
+
+	req, err := NewTSSRequest(identity, &TSSDevice{ECID: 0x1234, Generator: 0x1111111111111111})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.RequestTicketContext(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client's user agent is sent with everything else
+	if res, err := client.get(context.Background(), s.URL); err == nil {
+		res.Body.Close()
+	}
+
+	if len(agents) != 2 || agents[0] != tssUserAgent || agents[1] != client.UserAgent {
+		t.Fatalf("requests were made with user agents %q", agents)
+	}
+}
+
+func TestRequestTicketIMG3(t *testing.T) {
+	identity := &BuildIdentity{
+		ApChipID:  "0x8930",
+		ApBoardID: "0x02",
+		Manifest: BuildIdentityManifest{
+			"KernelCache": {PartialDigest: []byte{0x01, 0x02}, Trusted: true},
+		},
+	}
+
+	client, done := testTSSClient(NewTSSServer(identity))
+	defer done()
+
+	req, err := NewTSSRequest(identity, &TSSDevice{ECID: 5})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := client.RequestTicketContext(context.Background(), req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if blob.IsIMG4() || blob.Components["KernelCache"] == nil {
+		t.Fatalf("expected an IMG3 blob with a KernelCache, got %+v", blob)
+	}
+
+	v, err := blob.Verify(&BuildManifest{BuildIdentities: []BuildIdentity{*identity}})
+
+	if err != nil || !v.Valid || v.ECID != 5 {
+		t.Fatalf("blob did not verify: %+v, %v", v, err)
+	}
+}
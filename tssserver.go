@@ -0,0 +1,461 @@
+package ipsw
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+
+	"howett.net/plist"
+)
+
+// im4mComponentTags are the four character names IM4M tickets give to BuildManifest components.
+var im4mComponentTags = map[string]string{
+	"AppleLogo":          "logo",
+	"BatteryCharging0":   "chg0",
+	"BatteryCharging1":   "chg1",
+	"BatteryFull":        "batF",
+	"BatteryLow0":        "bat0",
+	"BatteryLow1":        "bat1",
+	"DeviceTree":         "dtre",
+	"KernelCache":        "krnl",
+	"LLB":                "illb",
+	"OS":                 "rosi",
+	"RecoveryMode":       "recm",
+	"RestoreDeviceTree":  "rdtr",
+	"RestoreKernelCache": "rkrn",
+	"RestoreRamDisk":     "rdsk",
+	"RestoreSEP":         "rsep",
+	"RestoreTrustCache":  "rtsc",
+	"SEP":                "sepi",
+	"StaticTrustCache":   "trst",
+	"SystemVolume":       "isys",
+	"iBEC":               "ibec",
+	"iBSS":               "ibss",
+	"iBoot":              "ibot",
+	"ftap":               "ftap",
+	"ftsp":               "ftsp",
+	"rfta":               "rfta",
+	"rfts":               "rfts",
+	"AOPFirmware":        "aopf",
+	"Homer":              "homr",
+	"Multitouch":         "mtfw",
+	"AudioCodecFirmware": "acfw",
+	"ANE":                "anef",
+	"GFX":                "gfxf",
+	"ISP":                "ispf",
+	"AVE":                "avef",
+	"PMP":                "pmpf",
+}
+
+// TSSServer is an in-process stand-in for Apple's TSS server, so that personalisation can be tested without a
+// network. It signs requests for the builds it has been told are signed, and refuses the rest with
+// TSSStatusNotSigned, as Apple's does. Its tickets are shaped like Apple's, but are not signed by Apple.
+//
+// A TSSServer is an http.Handler, so can be served with httptest.NewServer and used as a Client's TSSURL.
+type TSSServer struct {
+	mu     sync.RWMutex
+	signed map[string]bool
+}
+
+// NewTSSServer creates a TSSServer which signs the given build identities.
+func NewTSSServer(signed ...*BuildIdentity) *TSSServer {
+	s := &TSSServer{signed: make(map[string]bool)}
+
+	for _, identity := range signed {
+		s.Sign(identity)
+	}
+
+	return s
+}
+
+// Sign starts signing identity. Builds are told apart by their UniqueBuildID, or the digests of their
+// components if they have none.
+func (s *TSSServer) Sign(identity *BuildIdentity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.signed[identityBuildKey(identity)] = true
+}
+
+// Unsign stops signing identity.
+func (s *TSSServer) Unsign(identity *BuildIdentity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.signed, identityBuildKey(identity))
+}
+
+func (s *TSSServer) isSigned(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.signed[key]
+}
+
+func (s *TSSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request map[string]interface{}
+
+	if _, err := plist.Unmarshal(body, &request); err != nil {
+		fmt.Fprint(w, "STATUS=100&MESSAGE=An internal error occurred.")
+		return
+	}
+
+	if !s.isSigned(requestBuildKey(request)) {
+		fmt.Fprintf(w, "STATUS=%d&MESSAGE=This device isn't eligible for the requested build.", TSSStatusNotSigned)
+		return
+	}
+
+	response, err := tssTicket(request)
+
+	if err != nil {
+		fmt.Fprint(w, "STATUS=100&MESSAGE=An internal error occurred.")
+		return
+	}
+
+	ticket, err := plist.MarshalIndent(response, plist.XMLFormat, "\t")
+
+	if err != nil {
+		fmt.Fprint(w, "STATUS=100&MESSAGE=An internal error occurred.")
+		return
+	}
+
+	fmt.Fprintf(w, "STATUS=%d&MESSAGE=SUCCESS&%s%s", TSSStatusOK, tssTicketKey, ticket)
+}
+
+// identityBuildKey and requestBuildKey identify the build of an identity, and of a request made from it.
+func identityBuildKey(identity *BuildIdentity) string {
+	if len(identity.UniqueBuildID) > 0 {
+		return hex.EncodeToString(identity.UniqueBuildID)
+	}
+
+	digests := make(map[string][]byte)
+
+	for name, component := range identity.Manifest {
+		if isCoprocessorComponent(name) {
+			continue
+		}
+
+		digests[name] = append(append([]byte{}, component.Digest...), component.PartialDigest...)
+	}
+
+	return digestsBuildKey(digests)
+}
+
+func requestBuildKey(request map[string]interface{}) string {
+	if id, ok := request["UniqueBuildID"].([]byte); ok && len(id) > 0 {
+		return hex.EncodeToString(id)
+	}
+
+	digests := make(map[string][]byte)
+
+	for name, value := range request {
+		entry, ok := value.(map[string]interface{})
+
+		if !ok || isCoprocessorComponent(name) {
+			continue
+		}
+
+		digest, _ := entry["Digest"].([]byte)
+		partial, _ := entry["PartialDigest"].([]byte)
+
+		digests[name] = append(append([]byte{}, digest...), partial...)
+	}
+
+	return digestsBuildKey(digests)
+}
+
+func digestsBuildKey(digests map[string][]byte) string {
+	names := make([]string, 0, len(digests))
+
+	for name := range digests {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	h := sha1.New()
+
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%x;", name, digests[name])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// tssTicket returns the response to a signed request: an IM4M ApImg4Ticket, or for IMG3 requests an
+// APTicket and a blob for each component.
+func tssTicket(request map[string]interface{}) (map[string]interface{}, error) {
+	response := make(map[string]interface{})
+
+	if img4, _ := request["@ApImg4Ticket"].(bool); img4 {
+		ticket, err := tssIM4M(request)
+
+		if err != nil {
+			return nil, err
+		}
+
+		response["ApImg4Ticket"] = ticket
+	} else {
+		ecid, _ := request["ApECID"].(uint64)
+		chipID, _ := request["ApChipID"].(uint64)
+		boardID, _ := request["ApBoardID"].(uint64)
+
+		response["APTicket"] = img3Elements(
+			&IMG3Element{Signature: ChipElement, Data: leUint32(uint32(chipID))},
+			&IMG3Element{Signature: BordElement, Data: leUint32(uint32(boardID))},
+			&IMG3Element{Signature: EcidElement, Data: leUint64(ecid)},
+			&IMG3Element{Signature: ShshElement, Data: make([]byte, 128)},
+		)
+
+		for name, value := range request {
+			entry, ok := value.(map[string]interface{})
+
+			if !ok {
+				continue
+			}
+
+			partial, ok := entry["PartialDigest"].([]byte)
+
+			if !ok {
+				continue
+			}
+
+			response[name] = map[string]interface{}{
+				"PartialDigest": partial,
+				"Blob": img3Elements(
+					&IMG3Element{Signature: EcidElement, Data: leUint64(ecid)},
+					&IMG3Element{Signature: ShshElement, Data: make([]byte, 128)},
+				),
+			}
+		}
+	}
+
+	if bb, _ := request["@BBTicket"].(bool); bb {
+		response["BBTicket"] = make([]byte, 64)
+	}
+
+	return response, nil
+}
+
+func leUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+
+	return b
+}
+
+func leUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+
+	return b
+}
+
+// img3Elements writes elements without an image header, as IMG3 blobs hold them.
+func img3Elements(elems ...*IMG3Element) []byte {
+	buf := new(bytes.Buffer)
+
+	for _, elem := range elems {
+		header := elem.Header()
+		binary.Write(buf, binary.LittleEndian, &header)
+		buf.Write(elem.Data)
+		buf.Write(elem.Padding)
+	}
+
+	return buf.Bytes()
+}
+
+// tssIM4M builds an unsigned IM4M with the device properties and component digests of request.
+func tssIM4M(request map[string]interface{}) ([]byte, error) {
+	var manp [][]byte
+
+	properties := []struct {
+		key, tag string
+	}{
+		{"ApECID", "ECID"},
+		{"ApChipID", "CHIP"},
+		{"ApBoardID", "BORD"},
+		{"ApSecurityDomain", "SDOM"},
+		{"ApProductionMode", "CPRO"},
+		{"ApSecurityMode", "CSEC"},
+		{"ApNonce", "BNCH"},
+		{"SepNonce", "snon"},
+	}
+
+	for _, p := range properties {
+		value, ok := request[p.key]
+
+		if !ok {
+			continue
+		}
+
+		prop, err := im4mProperty(p.tag, value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		manp = append(manp, prop)
+	}
+
+	props, err := im4mProperty(manifestPropertiesTag, derSet(manp...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	manb := [][]byte{props}
+
+	names := make([]string, 0, len(request))
+
+	for name := range request {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	used := make(map[string]bool)
+
+	for _, name := range names {
+		entry, ok := request[name].(map[string]interface{})
+
+		if !ok || isCoprocessorComponent(name) {
+			continue
+		}
+
+		if _, ok := entry["Digest"].([]byte); !ok {
+			continue
+		}
+
+		tag, ok := im4mComponentTags[name]
+
+		if !ok || used[tag] {
+			tag = fmt.Sprintf("c%03d", len(used))
+		}
+
+		used[tag] = true
+
+		fields := [][]byte{}
+
+		for _, field := range []struct{ key, tag string }{{"Digest", "DGST"}, {"EPRO", "EPRO"}, {"ESEC", "ESEC"}} {
+			value, ok := entry[field.key]
+
+			if !ok {
+				continue
+			}
+
+			prop, err := im4mProperty(field.tag, value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			fields = append(fields, prop)
+		}
+
+		component, err := im4mProperty(tag, derSet(fields...))
+
+		if err != nil {
+			return nil, err
+		}
+
+		manb = append(manb, component)
+	}
+
+	body, err := im4mProperty(manifestBodyTag, derSet(manb...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var seq []byte
+
+	for _, v := range []interface{}{IM4MMagic, 0, derSet(body), make([]byte, 256)} {
+		b, err := derMarshal(v)
+
+		if err != nil {
+			return nil, err
+		}
+
+		seq = append(seq, b...)
+	}
+
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: seq})
+}
+
+// derRaw is DER which is already encoded.
+type derRaw []byte
+
+// derSet encodes a SET of the already encoded elems.
+func derSet(elems ...[]byte) derRaw {
+	var b []byte
+
+	for _, elem := range elems {
+		b = append(b, elem...)
+	}
+
+	out, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: b})
+
+	return out
+}
+
+func derMarshal(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case derRaw:
+		return v, nil
+	case uint64:
+		return asn1.Marshal(new(big.Int).SetUint64(v))
+	case string:
+		return asn1.MarshalWithParams(v, "ia5")
+	default:
+		return asn1.Marshal(v)
+	}
+}
+
+// im4mProperty encodes an IM4M property: a private tag of the four character name holding a
+// sequence of the name and value.
+func im4mProperty(name string, value interface{}) ([]byte, error) {
+	if len(name) != 4 {
+		return nil, fmt.Errorf("ipsw: im4m property name '%s' is not four characters", name)
+	}
+
+	n, err := derMarshal(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := derMarshal(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	seq, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: append(n, v...)})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassPrivate, Tag: int(binary.BigEndian.Uint32([]byte(name))), IsCompound: true, Bytes: seq})
+}
@@ -0,0 +1,643 @@
+package ipsw
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// DefaultWatchInterval is how often a Watcher polls if it has no Interval.
+const DefaultWatchInterval = 10 * time.Minute
+
+// EventType is the kind of change a Watcher has seen.
+type EventType int
+
+const (
+	NewIPSWEvent EventType = iota
+	NewOTAEvent
+	SigningStartedEvent
+	SigningStoppedEvent
+	NewKeysEvent
+)
+
+var eventTypeNames = map[EventType]string{
+	NewIPSWEvent:        "new_ipsw",
+	NewOTAEvent:         "new_ota",
+	SigningStartedEvent: "signing_started",
+	SigningStoppedEvent: "signing_stopped",
+	NewKeysEvent:        "new_keys",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *EventType) UnmarshalText(text []byte) error {
+	for eventType, name := range eventTypeNames {
+		if name == string(text) {
+			*t = eventType
+			return nil
+		}
+	}
+
+	return fmt.Errorf("ipsw: unknown event type '%s'", text)
+}
+
+// Event is a change seen by a Watcher. Only the fields for its Type are set.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+
+	Identifier Identifier `json:"identifier,omitempty"`
+	BuildID    string     `json:"buildid,omitempty"`
+	Version    string     `json:"version,omitempty"`
+
+	// Release is set for NewIPSWEvent, and NewOTAEvent from the api's release information.
+	Release *api.Release `json:"release,omitempty"`
+
+	// OTA is set for NewOTAEvent from the OTA XML.
+	OTA *OTAFirmware `json:"ota,omitempty"`
+
+	// Signing is set for SigningStartedEvent and SigningStoppedEvent.
+	Signing *SigningStatus `json:"signing,omitempty"`
+
+	// Keys holds the new keys of a NewKeysEvent.
+	Keys *api.FirmwareInfo `json:"keys,omitempty"`
+}
+
+// Handler is sent the events seen by a Watcher.
+type Handler interface {
+	Handle(ctx context.Context, event *Event) error
+}
+
+// HandlerFunc is a function which is a Handler.
+type HandlerFunc func(ctx context.Context, event *Event) error
+
+func (f HandlerFunc) Handle(ctx context.Context, event *Event) error {
+	return f(ctx, event)
+}
+
+// WebhookHandler is a Handler which POSTs each event as JSON to URL. Failed requests are retried
+// as the Client's Retry allows.
+type WebhookHandler struct {
+	URL string
+
+	// Client makes the requests. Defaults to a zero Client.
+	Client *Client
+}
+
+// NewWebhookHandler creates a WebhookHandler which posts to url.
+func NewWebhookHandler(url string) *WebhookHandler {
+	return &WebhookHandler{URL: url}
+}
+
+func (h *WebhookHandler) Handle(ctx context.Context, event *Event) error {
+	client := h.Client
+
+	if client == nil {
+		client = defaultClient()
+	}
+
+	body, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	opts := client.options(nil)
+
+	return opts.retry().Do(ctx, opts.logger(), func(attempt int) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+
+		if err != nil {
+			return permanentError{err}
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := client.do(req)
+
+		if err != nil {
+			return err
+		}
+
+		if err := checkResponse(h.URL, res); err != nil {
+			return err
+		}
+
+		return res.Body.Close()
+	})
+}
+
+// Watcher polls signing status, releases, OTAs and keys on a schedule, sending the changes it sees to its handlers.
+// The last known state is kept in StatePath, so changes made while it is not running are seen when it starts.
+// The first poll of a source with no saved state only records it, without sending events.
+//
+// Events a handler fails to take are kept with the state and sent to it again on the next poll, before any newer
+// events, so a handler may see an event more than once but sees them in order. Handlers are told apart by the
+// order they were registered in, so should be registered in the same order each time a Watcher is made.
+//
+// Sources without a URL, or which need API when it is nil, are not polled. A Watcher must not be modified once running.
+type Watcher struct {
+	// Client fetches SHSHJSONURL and OTAXMLURL. Defaults to a zero Client.
+	Client *Client
+
+	// API is used for release information and keys.
+	API *api.IPSWClient
+
+	SHSHJSONURL string
+	OTAXMLURL   string
+
+	// Releases enables polling the API's release information.
+	Releases bool
+
+	// KeysIdentifiers are the devices whose keys are polled from the API.
+	KeysIdentifiers []Identifier
+
+	// Interval is how often Run polls. Defaults to DefaultWatchInterval.
+	Interval time.Duration
+
+	// StatePath is the file the state is kept in. If empty, the state is only kept in memory.
+	StatePath string
+
+	// Logger receives errors from sources and handlers. Defaults to the Client's.
+	Logger Logger
+
+	mu       sync.Mutex
+	handlers []Handler
+	state    *watchState
+}
+
+// maxPendingEvents is the most events kept for handlers which are failing. The oldest are dropped past it.
+const maxPendingEvents = 1000
+
+// watchState is the last known state of each source, as it is saved. A nil map is a source which has
+// not been polled, so the maps are saved even when empty, or the next poll would only record the source again.
+type watchState struct {
+	SHSH     SHSHJSON        `json:"shsh"`
+	Releases map[string]bool `json:"releases"`
+	OTAs     map[string]bool `json:"otas"`
+	Keys     map[string]bool `json:"keys"`
+
+	// KeysSeeded are the identifiers whose keys have been polled, so are in Keys.
+	KeysSeeded map[Identifier]bool `json:"keys_seeded"`
+
+	// Pending are the events which have not yet been taken by every handler, oldest first.
+	Pending []*pendingEvent `json:"pending,omitempty"`
+}
+
+// pendingEvent is an event which has still to be sent to some handlers.
+type pendingEvent struct {
+	Event *Event `json:"event"`
+
+	// Handlers are the indexes of the handlers, in the order they were registered, which have not taken Event.
+	Handlers []int `json:"handlers"`
+}
+
+// Handle registers h to be sent every event.
+func (w *Watcher) Handle(h Handler) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.handlers = append(w.handlers, h)
+}
+
+func (w *Watcher) client() *Client {
+	if w.Client == nil {
+		return defaultClient()
+	}
+
+	return w.Client
+}
+
+func (w *Watcher) logger() Logger {
+	if w.Logger == nil {
+		return w.client().logger()
+	}
+
+	return w.Logger
+}
+
+// Run polls every Interval until ctx is done, returning ctx.Err(). Errors from polls are logged.
+func (w *Watcher) Run(ctx context.Context) error {
+	interval := w.Interval
+
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Poll(ctx); err != nil {
+			w.logger().Log("watch poll failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll sends any pending events, polls every source once, sends any changes to the handlers and saves the state.
+// A source which fails is logged and left as it was, and the first error is returned once every source has been polled.
+func (w *Watcher) Poll(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.state == nil {
+		state, err := w.loadState()
+
+		if err != nil {
+			return err
+		}
+
+		w.state = state
+	}
+
+	// handlers which fail are sent nothing more this poll, so their events stay in order.
+	failing := make(map[int]bool)
+
+	pending := w.state.Pending
+	w.state.Pending = nil
+
+	for _, p := range pending {
+		w.send(ctx, p.Event, p.Handlers, failing)
+	}
+
+	sources := []struct {
+		name    string
+		enabled bool
+		poll    func(ctx context.Context) ([]*Event, error)
+	}{
+		{"shsh", w.SHSHJSONURL != "", w.pollSHSH},
+		{"releases", w.Releases && w.API != nil, w.pollReleases},
+		{"ota", w.OTAXMLURL != "", w.pollOTA},
+		{"keys", len(w.KeysIdentifiers) > 0 && w.API != nil, w.pollKeys},
+	}
+
+	var firstErr error
+
+	for _, source := range sources {
+		if !source.enabled {
+			continue
+		}
+
+		// a source which fails part way returns the events it saw before failing.
+		events, err := source.poll(ctx)
+
+		for _, event := range events {
+			w.send(ctx, event, w.allHandlers(), failing)
+		}
+
+		if err != nil {
+			w.logger().Log("watch source failed", "source", source.name, "error", err)
+
+			if firstErr == nil {
+				firstErr = fmt.Errorf("ipsw: watching %s: %w", source.name, err)
+			}
+		}
+	}
+
+	if err := w.saveState(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
+
+func (w *Watcher) allHandlers() []int {
+	handlers := make([]int, len(w.handlers))
+
+	for i := range handlers {
+		handlers[i] = i
+	}
+
+	return handlers
+}
+
+// send sends event to the handlers with the given indexes, skipping those which are failing. Handler errors
+// are logged, and the event is kept in the state for the handlers which did not take it.
+func (w *Watcher) send(ctx context.Context, event *Event, handlers []int, failing map[int]bool) {
+	var remaining []int
+
+	for _, i := range handlers {
+		if i >= len(w.handlers) {
+			// the handler is no longer registered
+			continue
+		}
+
+		if !failing[i] {
+			err := w.handlers[i].Handle(ctx, event)
+
+			if err == nil {
+				continue
+			}
+
+			w.logger().Log("watch handler failed", "event", event.Type, "handler", i, "error", err)
+			failing[i] = true
+		}
+
+		remaining = append(remaining, i)
+	}
+
+	if len(remaining) == 0 {
+		return
+	}
+
+	w.state.Pending = append(w.state.Pending, &pendingEvent{Event: event, Handlers: remaining})
+
+	if dropped := len(w.state.Pending) - maxPendingEvents; dropped > 0 {
+		w.logger().Log("watch dropped pending events", "count", dropped)
+		w.state.Pending = w.state.Pending[dropped:]
+	}
+}
+
+func (w *Watcher) pollSHSH(ctx context.Context) ([]*Event, error) {
+	shsh, err := w.client().NewSHSHJSONContext(ctx, w.SHSHJSONURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	previous := w.state.SHSH
+	current := make(SHSHJSON, len(shsh))
+
+	for identifier, device := range shsh {
+		current[identifier] = device
+	}
+
+	// a device missing from a snapshot keeps its last known status, so it isn't seen as unsigned
+	// while it is missing, or as new when it returns.
+	for identifier, device := range previous {
+		if _, ok := current[identifier]; !ok {
+			current[identifier] = device
+		}
+	}
+
+	w.state.SHSH = current
+
+	if previous == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+
+	var events []*Event
+
+	for _, change := range DiffSHSHJSON(previous, current) {
+		eventType := SigningStartedEvent
+
+		if change.Type == BuildUnsigned {
+			eventType = SigningStoppedEvent
+		}
+
+		events = append(events, &Event{
+			Type:       eventType,
+			Time:       now,
+			Identifier: change.Identifier,
+			BuildID:    change.Status.BuildID,
+			Version:    change.Status.Version,
+			Signing:    change.Status,
+		})
+	}
+
+	return events, nil
+}
+
+func (w *Watcher) pollReleases(ctx context.Context) ([]*Event, error) {
+	releases, err := w.API.ReleaseInformationContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	first := w.state.Releases == nil
+
+	if first {
+		w.state.Releases = make(map[string]bool)
+	}
+
+	now := time.Now()
+
+	var events []*Event
+
+	for _, byDate := range releases {
+		for i := range byDate.Releases {
+			release := byDate.Releases[i]
+			key := strings.Join([]string{string(release.Type), release.Name, release.Date.UTC().Format(time.RFC3339)}, "|")
+
+			if w.state.Releases[key] {
+				continue
+			}
+
+			w.state.Releases[key] = true
+
+			if first || release.Type == api.ReleaseTypeSigning {
+				// signing changes are seen from the SHSHJSON.
+				continue
+			}
+
+			eventType := NewIPSWEvent
+
+			if release.Type == api.ReleaseTypeiOSOTA {
+				eventType = NewOTAEvent
+			}
+
+			events = append(events, &Event{Type: eventType, Time: now, Release: &release})
+		}
+	}
+
+	return events, nil
+}
+
+func (w *Watcher) pollOTA(ctx context.Context) ([]*Event, error) {
+	ota, err := w.client().NewOTAXMLContext(ctx, w.OTAXMLURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	first := w.state.OTAs == nil
+
+	if first {
+		w.state.OTAs = make(map[string]bool)
+	}
+
+	now := time.Now()
+
+	var events []*Event
+
+	for _, asset := range ota.Assets {
+		key := asset.GetURL()
+
+		if w.state.OTAs[key] {
+			continue
+		}
+
+		w.state.OTAs[key] = true
+
+		if first {
+			continue
+		}
+
+		events = append(events, &Event{
+			Type:    NewOTAEvent,
+			Time:    now,
+			BuildID: asset.BuildID,
+			Version: asset.Version,
+			OTA:     asset,
+		})
+	}
+
+	return events, nil
+}
+
+func (w *Watcher) pollKeys(ctx context.Context) ([]*Event, error) {
+	if w.state.Keys == nil {
+		w.state.Keys = make(map[string]bool)
+	}
+
+	if w.state.KeysSeeded == nil {
+		w.state.KeysSeeded = make(map[Identifier]bool)
+
+		// state saved before identifiers were seeded separately
+		for id := range w.state.Keys {
+			w.state.KeysSeeded[Identifier(strings.SplitN(id, "|", 2)[0])] = true
+		}
+	}
+
+	now := time.Now()
+
+	var events []*Event
+
+	for _, identifier := range w.KeysIdentifiers {
+		builds, err := w.API.KeysListContext(ctx, string(identifier))
+
+		if err != nil {
+			return events, err
+		}
+
+		// an identifier is seeded by its first successful poll, which only records its keys.
+		first := !w.state.KeysSeeded[identifier]
+		w.state.KeysSeeded[identifier] = true
+
+		for _, build := range builds {
+			fresh := build
+			fresh.Keys = nil
+
+			if len(build.Keys) == 0 {
+				// the list may only name the builds which have keys.
+				id := string(identifier) + "|" + build.BuildID
+
+				if w.state.Keys[id] {
+					continue
+				}
+
+				w.state.Keys[id] = true
+			}
+
+			for _, key := range build.Keys {
+				id := strings.Join([]string{string(identifier), build.BuildID, key.Image, key.Filename}, "|")
+
+				if w.state.Keys[id] {
+					continue
+				}
+
+				w.state.Keys[id] = true
+				fresh.Keys = append(fresh.Keys, key)
+			}
+
+			if first || (len(build.Keys) > 0 && len(fresh.Keys) == 0) {
+				continue
+			}
+
+			events = append(events, &Event{
+				Type:       NewKeysEvent,
+				Time:       now,
+				Identifier: identifier,
+				BuildID:    build.BuildID,
+				Keys:       &fresh,
+			})
+		}
+	}
+
+	return events, nil
+}
+
+func (w *Watcher) loadState() (*watchState, error) {
+	state := new(watchState)
+
+	if w.StatePath == "" {
+		return state, nil
+	}
+
+	data, err := ioutil.ReadFile(w.StatePath)
+
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("ipsw: invalid watch state '%s': %w", w.StatePath, err)
+	}
+
+	return state, nil
+}
+
+// saveState writes the state to a temporary file which replaces StatePath, so it is never left half written.
+func (w *Watcher) saveState() error {
+	if w.StatePath == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(w.state)
+
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(w.StatePath), filepath.Base(w.StatePath)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+
+		return err
+	}
+
+	return os.Rename(f.Name(), w.StatePath)
+}
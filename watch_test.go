@@ -0,0 +1,339 @@
+package ipsw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// testWatchServer serves the bodies set on it by path, or a 500 for paths set to "".
+type testWatchServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	bodies map[string]string
+}
+
+func newTestWatchServer() *testWatchServer {
+	s := &testWatchServer{bodies: make(map[string]string)}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		body, ok := s.bodies[r.URL.Path]
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if body == "" {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprint(w, body)
+	}))
+
+	return s
+}
+
+func (s *testWatchServer) set(path, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bodies[path] = body
+}
+
+func testSHSHDevice(identifier string, firmwares string) string {
+	return fmt.Sprintf(`"%s":{"board":"m68ap","model":"%s","cpid":"35072","bdid":"0","firmwares":[%s]}`, identifier, identifier, firmwares)
+}
+
+func testSigningStatus(build string, signing bool) string {
+	return fmt.Sprintf(`{"build":"%s","version":"1.0","signing":%t,"started":"2020-01-01 00:00:00","stopped":""}`, build, signing)
+}
+
+// recordingHandler records the events it is sent, failing while fail is set.
+type recordingHandler struct {
+	mu     sync.Mutex
+	fail   bool
+	events []*Event
+}
+
+func (h *recordingHandler) Handle(ctx context.Context, event *Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.fail {
+		return errors.New("handler unavailable")
+	}
+
+	h.events = append(h.events, event)
+
+	return nil
+}
+
+func (h *recordingHandler) builds() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var builds []string
+
+	for _, event := range h.events {
+		builds = append(builds, event.Type.String()+" "+event.BuildID)
+	}
+
+	return builds
+}
+
+var discardLogger = NewStdLogger(log.New(ioutil.Discard, "", 0))
+
+func testWatchDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "watch")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func quietRetry() *RetryPolicy {
+	retry := DefaultRetryPolicy()
+	retry.MaxAttempts = 3
+	retry.BaseDelay, retry.MaxDelay = time.Millisecond, time.Millisecond
+
+	return retry
+}
+
+func assertBuilds(t *testing.T, name string, got []string, want ...string) {
+	t.Helper()
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("%s was sent %v, expected %v", name, got, want)
+	}
+}
+
+func TestWatcherResendsFailedEvents(t *testing.T) {
+	s := newTestWatchServer()
+	defer s.Close()
+
+	dir, done := testWatchDir(t)
+	defer done()
+
+	failing, working := &recordingHandler{}, &recordingHandler{}
+
+	newWatcher := func() *Watcher {
+		w := &Watcher{
+			SHSHJSONURL: s.URL + "/shsh",
+			StatePath:   filepath.Join(dir, "state.json"),
+			Logger:      discardLogger,
+		}
+
+		w.Handle(failing)
+		w.Handle(working)
+
+		return w
+	}
+
+	s.set("/shsh", "{"+testSHSHDevice("iPhone1,1", testSigningStatus("1A", true))+"}")
+
+	if err := newWatcher().Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	s.set("/shsh", "{"+testSHSHDevice("iPhone1,1", testSigningStatus("1A", false)+","+testSigningStatus("1B", true))+"}")
+	failing.fail = true
+
+	if err := newWatcher().Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBuilds(t, "failing handler", failing.builds())
+	assertBuilds(t, "working handler", working.builds(), "signing_stopped 1A", "signing_started 1B")
+
+	// a new watcher picks up the pending events from the state, and only sends them to the handler which missed them
+	failing.fail = false
+
+	if err := newWatcher().Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBuilds(t, "failing handler", failing.builds(), "signing_stopped 1A", "signing_started 1B")
+	assertBuilds(t, "working handler", working.builds(), "signing_stopped 1A", "signing_started 1B")
+
+	if err := newWatcher().Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBuilds(t, "failing handler", failing.builds(), "signing_stopped 1A", "signing_started 1B")
+}
+
+func TestWatcherSHSHMissingDevice(t *testing.T) {
+	s := newTestWatchServer()
+	defer s.Close()
+
+	h := &recordingHandler{}
+	w := &Watcher{SHSHJSONURL: s.URL + "/shsh", Logger: discardLogger}
+	w.Handle(h)
+
+	iPhone := testSHSHDevice("iPhone1,1", testSigningStatus("1A", true))
+	iPad := testSHSHDevice("iPad1,1", testSigningStatus("9A", true))
+
+	for _, snapshot := range []string{iPhone + "," + iPad, iPhone, iPhone + "," + iPad} {
+		s.set("/shsh", "{"+snapshot+"}")
+
+		if err := w.Poll(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertBuilds(t, "handler", h.builds())
+
+	s.set("/shsh", "{"+iPhone+","+testSHSHDevice("iPad1,1", testSigningStatus("9A", false))+"}")
+
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBuilds(t, "handler", h.builds(), "signing_stopped 9A")
+}
+
+func TestWatcherSeedsKeysByIdentifier(t *testing.T) {
+	s := newTestWatchServer()
+	defer s.Close()
+
+	h := &recordingHandler{}
+	w := &Watcher{
+		API:             api.NewIPSWClient(s.URL, nil),
+		KeysIdentifiers: []Identifier{"iPhone1,1", "iPhone1,2"},
+		Logger:          discardLogger,
+	}
+	w.Handle(h)
+
+	s.set("/keys/device/iPhone1,1", `[{"identifier":"iPhone1,1","buildid":"1A"}]`)
+	s.set("/keys/device/iPhone1,2", "")
+
+	if err := w.Poll(context.Background()); err == nil {
+		t.Fatal("expected the failing identifier to fail the poll")
+	}
+
+	// iPhone1,2 is seeded by its first successful poll, not by iPhone1,1's
+	s.set("/keys/device/iPhone1,2", `[{"identifier":"iPhone1,2","buildid":"5A"}]`)
+
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBuilds(t, "handler", h.builds())
+
+	s.set("/keys/device/iPhone1,2", `[{"identifier":"iPhone1,2","buildid":"5A"},{"identifier":"iPhone1,2","buildid":"5B"}]`)
+
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBuilds(t, "handler", h.builds(), "new_keys 5B")
+}
+
+func TestWebhookHandlerRetries(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+
+		if requests < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+
+	h := &WebhookHandler{URL: s.URL, Client: &Client{Retry: quietRetry(), Logger: discardLogger}}
+
+	if err := h.Handle(context.Background(), &Event{Type: NewIPSWEvent, BuildID: "1A"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestWatcherEmptyFirstPoll(t *testing.T) {
+	s := newTestWatchServer()
+	defer s.Close()
+
+	dir, done := testWatchDir(t)
+	defer done()
+
+	h := &recordingHandler{}
+
+	newWatcher := func() *Watcher {
+		w := &Watcher{SHSHJSONURL: s.URL + "/shsh", StatePath: filepath.Join(dir, "state.json"), Logger: discardLogger}
+		w.Handle(h)
+
+		return w
+	}
+
+	s.set("/shsh", "{}")
+
+	if err := newWatcher().Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the empty snapshot was recorded, so a restarted watcher sends what is new since
+	s.set("/shsh", "{"+testSHSHDevice("iPhone1,1", testSigningStatus("1A", true))+"}")
+
+	if err := newWatcher().Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBuilds(t, "handler", h.builds(), "signing_started 1A")
+}
+
+func TestWatcherKeysInIdentifierOrder(t *testing.T) {
+	s := newTestWatchServer()
+	defer s.Close()
+
+	h := &recordingHandler{}
+	w := &Watcher{
+		API:             api.NewIPSWClient(s.URL, nil),
+		KeysIdentifiers: []Identifier{"iPhone2,1", "iPhone1,1"},
+		Logger:          discardLogger,
+	}
+	w.Handle(h)
+
+	s.set("/keys/device/iPhone2,1", `[]`)
+	s.set("/keys/device/iPhone1,1", `[]`)
+
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	s.set("/keys/device/iPhone2,1", `[{"identifier":"iPhone2,1","buildid":"7A"}]`)
+	s.set("/keys/device/iPhone1,1", `[{"identifier":"iPhone1,1","buildid":"5A"}]`)
+
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBuilds(t, "handler", h.builds(), "new_keys 7A", "new_keys 5A")
+}